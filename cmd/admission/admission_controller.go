@@ -1,25 +1,26 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"log"
 	"net/http"
-
-	"strings"
+	"time"
 )
 
 const (
 	jsonContentType = `application/json`
+
+	// admissionDeadlineMargin is how much earlier than the API server's webhook timeout an admitFunc has to finish,
+	// leaving time to send the response.
+	admissionDeadlineMargin = time.Second
 )
 
 var (
@@ -30,18 +31,48 @@ var (
 type patchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
+	Value interface{} `json:"value"`
 }
 
-// admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
-// operations to be applied in case of success, or the error that will be shown when the operation is rejected.
-type admitFunc func(*v1beta1.AdmissionRequest, string) ([]patchOperation, error)
+// MarshalJSON encodes the operation. The value is only left out of remove operations, the other operations require it
+// even if it is null.
+func (op patchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type operation patchOperation
+	return json.Marshal(operation(op))
+}
+
+// admitFunc is a callback for admission controller logic. Given a version-neutral admissionRequest, it returns the
+// sequence of patch operations to be applied in case of success, or the error that will be shown when the operation
+// is rejected, along with any warnings to be returned to the client in either case. Ownership decisions are based on
+// the requesting user carried in admissionRequest.UserInfo.
+type admitFunc func(context.Context, *admissionRequest) ([]patchOperation, []string, error)
 
 // isKubeNamespace checks if the given namespace is a Kubernetes-owned namespace.
 func isKubeNamespace(ns string) bool {
 	return ns == metav1.NamespacePublic || ns == metav1.NamespaceSystem
 }
 
+// admissionContext returns the context for admitting the given HTTP request. The API server appends its webhook timeout
+// as the timeout query parameter, the context expires shortly before it.
+func admissionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	if timeout > 2*admissionDeadlineMargin {
+		timeout -= admissionDeadlineMargin
+	} else {
+		timeout /= 2
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
 // doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
 // request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
 // bytes.
@@ -62,103 +93,51 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) (
 		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	// Step 2: Parse the AdmissionReview request.
-
-	var admissionReviewReq v1beta1.AdmissionReview
+	// Step 2: Parse the AdmissionReview request, in whichever API version it was sent.
 
-	if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not deserialize request: %v", err)
-	} else if admissionReviewReq.Request == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, errors.New("malformed admission review: request is nil")
-	}
-
-	r.Body = ioutil.NopCloser(bytes.NewReader(body))
-
-	// parse the request body into a json object
-	var requestJson map[string]interface{}
-	err = json.NewDecoder(r.Body).Decode(&requestJson)
+	admissionReq, reviewTypeMeta, err := decodeAdmissionReview(body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		logrus.Errorf("Error decoding request body: %v", err)
 		return nil, err
 	}
 
-	// Convert requestJson["request"].(map[string]interface{})["object"] to unstructured
-	objectJson := requestJson["request"].(map[string]interface{})["object"].(map[string]interface{})
-	newObject := &unstructured.Unstructured{Object: objectJson}
-
-	oldObjectJson := requestJson["request"].(map[string]interface{})["oldObject"].(map[string]interface{})
-	oldObject := &unstructured.Unstructured{Object: oldObjectJson}
-
-	ownerIP := ""
-	stopWatching := false
-	if newObject.GetLabels()["app.heimdall.io/owner"] != "" {
-		ownerIP = newObject.GetLabels()["app.heimdall.io/owner"]
-	} else if oldObject.GetLabels()["app.heimdall.io/owner"] != "" && newObject.GetLabels()["app.heimdall.io/owner"] == "" {
-		ownerIP = ""
-		stopWatching = true
-	} else {
-		// cancel since this is not a heimdall object
-		w.WriteHeader(http.StatusAccepted)
-		return nil, nil
-	}
-
-	// if owner = "", then either the object is not a heimdall object OR the label has been removed
-	// check for the latter first
-
-	senderIP := strings.Split(r.RemoteAddr, ":")[0]
-
-	if !stopWatching {
-		logrus.Infof("────────────────────────────────────────────────────────────")
-		logrus.Infof("processing new request for resource %s/%s", newObject.GetNamespace(), newObject.GetName())
-		logrus.Infof("request sender ip: %s", senderIP)
-	}
-
-	if ownerIP == "" {
-		// allow the request if the owner label is not set
-		ownerIP = senderIP
-	}
-
 	// Step 3: Construct the AdmissionReview response.
 
-	admissionReviewResponse := v1beta1.AdmissionReview{
-		TypeMeta: admissionReviewReq.TypeMeta,
-		Response: &v1beta1.AdmissionResponse{
-			UID: admissionReviewReq.Request.UID,
-		},
+	admissionResp := &admissionResponse{
+		UID:     admissionReq.UID,
+		Allowed: true,
 	}
 
-	var patchOps []patchOperation
-	// Apply the admit() function only for non-Kubernetes namespaces. For objects in Kubernetes namespaces, return
-	// an empty set of patch operations.
-	if !isKubeNamespace(admissionReviewReq.Request.Namespace) {
-		patchOps, err = admit(admissionReviewReq.Request, senderIP)
+	// Apply the admit() function only for non-Kubernetes namespaces. Objects in Kubernetes namespaces are admitted
+	// without any patch operations.
+	if !isKubeNamespace(admissionReq.Namespace) {
+		ctx, cancel := admissionContext(r)
+		patchOps, warnings, err := admit(ctx, admissionReq)
+		cancel()
+		admissionResp.Warnings = warnings
 
 		if err != nil {
-			admissionReviewResponse.Response.Allowed = false
-			admissionReviewResponse.Response.Result = &metav1.Status{
+			admissionResp.Allowed = false
+			admissionResp.Result = &metav1.Status{
 				Message: err.Error(),
 			}
 
-		} else {
+		} else if len(patchOps) > 0 {
 			// Otherwise, encode the patch operations to JSON and return a positive response.
 			patchBytes, err := json.Marshal(patchOps)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
 			}
-			admissionReviewResponse.Response.Allowed = true
-			admissionReviewResponse.Response.Patch = patchBytes
-			admissionReviewResponse.Response.PatchType = new(v1beta1.PatchType)
-			*admissionReviewResponse.Response.PatchType = v1beta1.PatchTypeJSONPatch
+			admissionResp.Patch = patchBytes
+			admissionResp.PatchType = new(admissionv1.PatchType)
+			*admissionResp.PatchType = admissionv1.PatchTypeJSONPatch
 		}
 
 	}
 
-	// Return the AdmissionReview with a response as JSON.
-	bytes, err := json.Marshal(&admissionReviewResponse)
+	// Return the AdmissionReview with a response as JSON, in the same API version as the request.
+	bytes, err := encodeAdmissionReview(reviewTypeMeta, admissionResp)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling response: %v", err)
 	}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// admissionRequest is a version-neutral view of an AdmissionRequest, decoded from either an admission.k8s.io/v1 or an
+// admission.k8s.io/v1beta1 AdmissionReview. The two API versions carry identical request fields.
+type admissionRequest struct {
+	UID                types.UID
+	Kind               metav1.GroupVersionKind
+	Resource           metav1.GroupVersionResource
+	SubResource        string
+	RequestKind        *metav1.GroupVersionKind
+	RequestResource    *metav1.GroupVersionResource
+	RequestSubResource string
+	Name               string
+	Namespace          string
+	Operation          admissionv1.Operation
+	UserInfo           authenticationv1.UserInfo
+	Object             runtime.RawExtension
+	OldObject          runtime.RawExtension
+	DryRun             bool
+	Options            runtime.RawExtension
+}
+
+// admissionResponse is a version-neutral AdmissionResponse, encoded in the API version of the AdmissionReview it
+// answers.
+type admissionResponse struct {
+	UID       types.UID
+	Allowed   bool
+	Result    *metav1.Status
+	Patch     []byte
+	PatchType *admissionv1.PatchType
+	Warnings  []string
+}
+
+var (
+	admissionV1APIVersion      = admissionv1.SchemeGroupVersion.String()
+	admissionV1beta1APIVersion = v1beta1.SchemeGroupVersion.String()
+)
+
+// decodeAdmissionReview detects the API version of the given AdmissionReview and decodes its request. The API version
+// is returned so that the response can be encoded in the same version.
+func decodeAdmissionReview(body []byte) (*admissionRequest, metav1.TypeMeta, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, typeMeta, fmt.Errorf("could not deserialize request: %v", err)
+	}
+
+	switch typeMeta.APIVersion {
+	case admissionV1APIVersion:
+		var review admissionv1.AdmissionReview
+		if _, _, err := universalDeserializer.Decode(body, nil, &review); err != nil {
+			return nil, typeMeta, fmt.Errorf("could not deserialize request: %v", err)
+		} else if review.Request == nil {
+			return nil, typeMeta, errors.New("malformed admission review: request is nil")
+		}
+		return fromV1Request(review.Request), typeMeta, nil
+
+	case admissionV1beta1APIVersion, "":
+		// Older API servers may omit the apiVersion, in which case v1beta1 is assumed.
+		var review v1beta1.AdmissionReview
+		if _, _, err := universalDeserializer.Decode(body, nil, &review); err != nil {
+			return nil, typeMeta, fmt.Errorf("could not deserialize request: %v", err)
+		} else if review.Request == nil {
+			return nil, typeMeta, errors.New("malformed admission review: request is nil")
+		}
+		typeMeta.APIVersion = admissionV1beta1APIVersion
+		return fromV1beta1Request(review.Request), typeMeta, nil
+	}
+
+	return nil, typeMeta, fmt.Errorf("unsupported admission review version %q, only %s and %s are supported",
+		typeMeta.APIVersion, admissionV1APIVersion, admissionV1beta1APIVersion)
+}
+
+// encodeAdmissionReview wraps the response in an AdmissionReview of the given API version and encodes it as JSON.
+func encodeAdmissionReview(typeMeta metav1.TypeMeta, resp *admissionResponse) ([]byte, error) {
+	if typeMeta.Kind == "" {
+		typeMeta.Kind = "AdmissionReview"
+	}
+
+	var review interface{}
+	switch typeMeta.APIVersion {
+	case admissionV1APIVersion:
+		review = &admissionv1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: &admissionv1.AdmissionResponse{
+				UID:       resp.UID,
+				Allowed:   resp.Allowed,
+				Result:    resp.Result,
+				Patch:     resp.Patch,
+				PatchType: resp.PatchType,
+				Warnings:  resp.Warnings,
+			},
+		}
+	case admissionV1beta1APIVersion:
+		var patchType *v1beta1.PatchType
+		if resp.PatchType != nil {
+			patchType = new(v1beta1.PatchType)
+			*patchType = v1beta1.PatchType(*resp.PatchType)
+		}
+		review = &v1beta1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: &v1beta1.AdmissionResponse{
+				UID:       resp.UID,
+				Allowed:   resp.Allowed,
+				Result:    resp.Result,
+				Patch:     resp.Patch,
+				PatchType: patchType,
+				Warnings:  resp.Warnings,
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported admission review version %q", typeMeta.APIVersion)
+	}
+
+	return json.Marshal(review)
+}
+
+func fromV1Request(req *admissionv1.AdmissionRequest) *admissionRequest {
+	return &admissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          req.Operation,
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun != nil && *req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+func fromV1beta1Request(req *v1beta1.AdmissionRequest) *admissionRequest {
+	return &admissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          admissionv1.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun != nil && *req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+// decodeObjects decodes the object and old object carried by the request. Which of them are present depends on the
+// operation: CREATE carries no old object, DELETE carries no new object (and no old object either on API servers older
+// than 1.15), and for CONNECT the object is the connect options (e.g. PodExecOptions) rather than the resource itself.
+// Absent objects are returned as nil.
+func decodeObjects(req *admissionRequest) (oldObj, newObj *unstructured.Unstructured, err error) {
+	if oldObj, err = decodeObject(req.OldObject); err != nil {
+		return nil, nil, fmt.Errorf("failed decoding existing object: %v", err)
+	}
+	if req.Operation == admissionv1.Connect {
+		return oldObj, nil, nil
+	}
+	if newObj, err = decodeObject(req.Object); err != nil {
+		return nil, nil, fmt.Errorf("failed decoding new object: %v", err)
+	}
+	return oldObj, newObj, nil
+}
+
+func decodeObject(raw runtime.RawExtension) (*unstructured.Unstructured, error) {
+	data := bytes.TrimSpace(raw.Raw)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+// testOldObject and testNewObject are the objects of the test AdmissionReviews.
+const (
+	testOldObject = `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"old"}}`
+	testNewObject = `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"new"}}`
+)
+
+func TestDecodeAdmissionReview(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+
+		wantErr        bool
+		wantAPIVersion string
+		wantOperation  admissionv1.Operation
+		wantDryRun     bool
+		// wantOld and wantNew are the names of the decoded objects, empty if they are absent.
+		wantOld, wantNew string
+	}{
+		{
+			name: "v1",
+			body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"1",` +
+				`"kind":{"group":"apps","version":"v1","kind":"Deployment"},"name":"web","namespace":"team-a",` +
+				`"operation":"UPDATE","userInfo":{"username":"jane"},"dryRun":true,` +
+				`"object":` + testNewObject + `,"oldObject":` + testOldObject + `}}`,
+			wantAPIVersion: "admission.k8s.io/v1",
+			wantOperation:  admissionv1.Update,
+			wantDryRun:     true,
+			wantOld:        "old",
+			wantNew:        "new",
+		},
+		{
+			name: "v1beta1",
+			body: `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"1",` +
+				`"kind":{"group":"apps","version":"v1","kind":"Deployment"},"name":"web","namespace":"team-a",` +
+				`"operation":"UPDATE","userInfo":{"username":"jane"},` +
+				`"object":` + testNewObject + `,"oldObject":` + testOldObject + `}}`,
+			wantAPIVersion: "admission.k8s.io/v1beta1",
+			wantOperation:  admissionv1.Update,
+			wantOld:        "old",
+			wantNew:        "new",
+		},
+		{
+			name: "empty apiVersion",
+			body: `{"request":{"uid":"1","kind":{"group":"apps","version":"v1","kind":"Deployment"},"name":"web",` +
+				`"operation":"CREATE","userInfo":{"username":"jane"},"object":` + testNewObject + `}}`,
+			wantAPIVersion: "admission.k8s.io/v1beta1",
+			wantOperation:  admissionv1.Create,
+			wantNew:        "new",
+		},
+		{
+			name: "null objects",
+			body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"1",` +
+				`"kind":{"group":"apps","version":"v1","kind":"Deployment"},"name":"web","operation":"DELETE",` +
+				`"userInfo":{"username":"jane"},"object":null,"oldObject":null}}`,
+			wantAPIVersion: "admission.k8s.io/v1",
+			wantOperation:  admissionv1.Delete,
+		},
+		{
+			name: "absent objects",
+			body: `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"1",` +
+				`"kind":{"group":"apps","version":"v1","kind":"Deployment"},"name":"web","operation":"DELETE",` +
+				`"userInfo":{"username":"jane"}}}`,
+			wantAPIVersion: "admission.k8s.io/v1beta1",
+			wantOperation:  admissionv1.Delete,
+		},
+		{
+			name: "deletion with old object",
+			body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"1",` +
+				`"kind":{"group":"apps","version":"v1","kind":"Deployment"},"name":"web","operation":"DELETE",` +
+				`"userInfo":{"username":"jane"},"object":null,"oldObject":` + testOldObject + `}}`,
+			wantAPIVersion: "admission.k8s.io/v1",
+			wantOperation:  admissionv1.Delete,
+			wantOld:        "old",
+		},
+		{
+			name: "connect options",
+			body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"1",` +
+				`"kind":{"group":"","version":"v1","kind":"PodExecOptions"},"name":"web","operation":"CONNECT",` +
+				`"userInfo":{"username":"jane"},"object":{"kind":"PodExecOptions","command":["sh"]}}}`,
+			wantAPIVersion: "admission.k8s.io/v1",
+			wantOperation:  admissionv1.Connect,
+		},
+		{
+			name:    "unsupported apiVersion",
+			body:    `{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview","request":{"uid":"1"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing request",
+			body:    `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid JSON",
+			body:    `{"apiVersion":`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, typeMeta, err := decodeAdmissionReview([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("decodeAdmissionReview = %+v, want an error", req)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeAdmissionReview failed: %v", err)
+			}
+			if typeMeta.APIVersion != tt.wantAPIVersion {
+				t.Errorf("apiVersion = %q, want %q", typeMeta.APIVersion, tt.wantAPIVersion)
+			}
+			if req.UID != "1" || req.Name != "web" || req.UserInfo.Username != "jane" {
+				t.Errorf("request = %+v, want uid 1, name web and user jane", req)
+			}
+			if req.Operation != tt.wantOperation {
+				t.Errorf("operation = %s, want %s", req.Operation, tt.wantOperation)
+			}
+			if req.DryRun != tt.wantDryRun {
+				t.Errorf("dryRun = %t, want %t", req.DryRun, tt.wantDryRun)
+			}
+
+			oldObj, newObj, err := decodeObjects(req)
+			if err != nil {
+				t.Fatalf("decodeObjects failed: %v", err)
+			}
+			if got := testObjectName(oldObj); got != tt.wantOld {
+				t.Errorf("old object = %q, want %q", got, tt.wantOld)
+			}
+			if got := testObjectName(newObj); got != tt.wantNew {
+				t.Errorf("new object = %q, want %q", got, tt.wantNew)
+			}
+		})
+	}
+}
+
+func TestEncodeAdmissionReview(t *testing.T) {
+	patchType := admissionv1.PatchTypeJSONPatch
+	resp := &admissionResponse{
+		UID:       "1",
+		Allowed:   true,
+		Patch:     []byte(`[]`),
+		PatchType: &patchType,
+		Warnings:  []string{"reverted /spec/replicas"},
+	}
+	tests := []struct {
+		name     string
+		typeMeta metav1.TypeMeta
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "v1",
+			typeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			want: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","response":{"uid":"1","allowed":true,` +
+				`"patch":"W10=","patchType":"JSONPatch","warnings":["reverted /spec/replicas"]}}`,
+		},
+		{
+			name:     "v1beta1",
+			typeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+			want: `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","response":{"uid":"1",` +
+				`"allowed":true,"patch":"W10=","patchType":"JSONPatch","warnings":["reverted /spec/replicas"]}}`,
+		},
+		{
+			name:     "missing kind",
+			typeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1"},
+			want: `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","response":{"uid":"1",` +
+				`"allowed":true,"patch":"W10=","patchType":"JSONPatch","warnings":["reverted /spec/replicas"]}}`,
+		},
+		{
+			name:     "unsupported apiVersion",
+			typeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v2", Kind: "AdmissionReview"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeAdmissionReview(tt.typeMeta, resp)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("encodeAdmissionReview = %s, want an error", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("encodeAdmissionReview failed: %v", err)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("invalid AdmissionReview %s: %v", data, err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatalf("invalid test JSON %s: %v", tt.want, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("encodeAdmissionReview = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+// TestAdmissionReviewRoundTrip checks that a response is encoded in the API version its request was decoded from.
+func TestAdmissionReviewRoundTrip(t *testing.T) {
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1", ""} {
+		body := `{"apiVersion":"` + apiVersion + `","kind":"AdmissionReview","request":{"uid":"1",` +
+			`"kind":{"group":"apps","version":"v1","kind":"Deployment"},"name":"web","operation":"CREATE",` +
+			`"userInfo":{"username":"jane"}}}`
+		req, typeMeta, err := decodeAdmissionReview([]byte(body))
+		if err != nil {
+			t.Fatalf("decodeAdmissionReview(%q) failed: %v", apiVersion, err)
+		}
+		data, err := encodeAdmissionReview(typeMeta, &admissionResponse{UID: req.UID, Allowed: true})
+		if err != nil {
+			t.Fatalf("encodeAdmissionReview(%q) failed: %v", apiVersion, err)
+		}
+		var review metav1.TypeMeta
+		if err := json.Unmarshal(data, &review); err != nil {
+			t.Fatalf("invalid AdmissionReview %s: %v", data, err)
+		}
+		want := apiVersion
+		if want == "" {
+			want = "admission.k8s.io/v1beta1"
+		}
+		if review.APIVersion != want || review.Kind != "AdmissionReview" {
+			t.Errorf("response to %q is a %s %s, want a %s AdmissionReview", apiVersion, review.APIVersion, review.Kind, want)
+		}
+	}
+}
+
+func testObjectName(obj interface{ GetName() string }) string {
+	if reflect.ValueOf(obj).IsNil() {
+		return ""
+	}
+	return obj.GetName()
+}
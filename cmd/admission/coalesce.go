@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"time"
+)
+
+const (
+	// requestUIDTTL is how long the UIDs of admission requests are remembered to detect retries. It is the maximum
+	// webhook timeout, the API server does not retry a request later than that.
+	requestUIDTTL = 30 * time.Second
+	// coalesceFlushTimeout bounds publishing a coalesced reconcile request at the end of its window.
+	coalesceFlushTimeout = 10 * time.Second
+)
+
+// coalescingSink suppresses bursts of reconcile requests for the same resource, e.g. from a controller fighting over
+// an owned resource. The first request for a resource is published right away and opens a window, whose length depends
+// on the priority of the resource, during which further requests are only counted. When the window ends, the latest of
+// them is published with the count in its Suppressed field, opening the next window. Retries of an admission request
+// already seen are dropped.
+type coalescingSink struct {
+	sink            Sink
+	windows         map[priority.Priority]time.Duration
+	defaultPriority priority.Priority
+
+	mu        sync.Mutex
+	resources map[string]*coalescedResource
+	requests  map[types.UID]time.Time
+	pruned    time.Time
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// coalescedResource is the open coalescing window of a resource.
+type coalescedResource struct {
+	timer *time.Timer
+	// pending is the latest suppressed request, nil if there is none.
+	pending    *reconcile.Event
+	suppressed int
+}
+
+// newCoalescingSink wraps the given sink, coalescing the requests for a resource within the window of its priority.
+func newCoalescingSink(sink Sink, windows map[priority.Priority]time.Duration, defaultPriority priority.Priority) *coalescingSink {
+	return &coalescingSink{
+		sink:            sink,
+		windows:         windows,
+		defaultPriority: defaultPriority,
+		resources:       make(map[string]*coalescedResource),
+		requests:        make(map[types.UID]time.Time),
+		pruned:          time.Now(),
+	}
+}
+
+// resourceKey identifies the resource of an event across API versions.
+func resourceKey(event *reconcile.Event) string {
+	return fmt.Sprintf("%s/%s/%s/%s", event.Group, event.Kind, event.Namespace, event.Name)
+}
+
+// Publish publishes the event, unless it is a retry or falls into the window of an earlier request for the resource.
+func (s *coalescingSink) Publish(ctx context.Context, event *reconcile.Event) error {
+	key := resourceKey(event)
+
+	s.mu.Lock()
+	if s.isRetry(event.RequestUID) {
+		s.mu.Unlock()
+		metricCoalesceRetries.Add(1)
+		logrus.Infof("dropped reconcile request for retried admission %s of resource %s", event.RequestUID, key)
+		return nil
+	}
+	if r, ok := s.resources[key]; ok {
+		r.pending = event
+		r.suppressed++
+		s.remember(event.RequestUID)
+		s.mu.Unlock()
+		metricCoalesceSuppressed.Add(1)
+		return nil
+	}
+	// Open the window before publishing, so that concurrent requests for the resource are coalesced.
+	r := &coalescedResource{}
+	s.resources[key] = r
+	s.mu.Unlock()
+
+	err := s.sink.Publish(ctx, event)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil && r.pending == nil {
+		// Nothing was coalesced yet, let the next request for the resource try again.
+		delete(s.resources, key)
+		return err
+	}
+	if err == nil {
+		s.remember(event.RequestUID)
+	}
+	s.startWindow(key, r, s.windows[eventPriority(event, s.defaultPriority)])
+	return err
+}
+
+// startWindow closes the window of the given resource once it elapsed, or right away if the sink is closing. It must
+// be called with mu held.
+func (s *coalescingSink) startWindow(key string, r *coalescedResource, window time.Duration) {
+	if s.closed {
+		window = 0
+	}
+	s.wg.Add(1)
+	r.timer = time.AfterFunc(window, func() { s.flush(key) })
+}
+
+// flush ends the window of the given resource, publishing its pending request if there is one.
+func (s *coalescingSink) flush(key string) {
+	defer s.wg.Done()
+
+	s.mu.Lock()
+	r := s.resources[key]
+	delete(s.resources, key)
+	if r.pending != nil && !s.closed {
+		// The pending request opens the next window, so that a continuing burst is published once per window.
+		s.resources[key] = &coalescedResource{}
+		s.startWindow(key, s.resources[key], s.windows[eventPriority(r.pending, s.defaultPriority)])
+	}
+	s.mu.Unlock()
+	if r.pending == nil {
+		return
+	}
+
+	event := r.pending
+	event.Suppressed = r.suppressed
+	ctx, cancel := context.WithTimeout(context.Background(), coalesceFlushTimeout)
+	defer cancel()
+	if err := s.sink.Publish(ctx, event); err != nil {
+		logrus.Errorf("ERROR: failed to queue coalesced reconcile request for resource %s: %v", key, err)
+		return
+	}
+	logrus.Infof("queued reconcile request for resource %s, coalescing %d requests", key, r.suppressed)
+}
+
+// isRetry returns whether a request with the given UID was seen recently. It must be called with mu held.
+func (s *coalescingSink) isRetry(uid types.UID) bool {
+	if uid == "" {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(s.pruned) > requestUIDTTL {
+		for u, seen := range s.requests {
+			if now.Sub(seen) > requestUIDTTL {
+				delete(s.requests, u)
+			}
+		}
+		s.pruned = now
+	}
+	seen, ok := s.requests[uid]
+	return ok && now.Sub(seen) <= requestUIDTTL
+}
+
+// remember records the UID of a handled request. It must be called with mu held.
+func (s *coalescingSink) remember(uid types.UID) {
+	if uid != "" {
+		s.requests[uid] = time.Now()
+	}
+}
+
+// Close publishes the pending requests right away, without waiting for their windows to end, and closes the sink.
+func (s *coalescingSink) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var flushNow []string
+	for key, r := range s.resources {
+		if r.timer != nil && r.timer.Stop() {
+			flushNow = append(flushNow, key)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, key := range flushNow {
+		s.flush(key)
+	}
+	s.wg.Wait()
+	return s.sink.Close()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"k8s.io/apimachinery/pkg/types"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescingSink(t *testing.T) {
+	tests := []struct {
+		name string
+		// requests are the published requests as name/request UID.
+		requests []string
+		// failing are the request UIDs the sink fails to publish.
+		failing []types.UID
+		// want are the requests the sink received as name/request UID/suppressed, in any order.
+		want []string
+	}{
+		{
+			name:     "single request",
+			requests: []string{"a/1"},
+			want:     []string{"a/1/0"},
+		},
+		{
+			name:     "burst",
+			requests: []string{"a/1", "a/2", "a/3"},
+			want:     []string{"a/1/0", "a/3/2"},
+		},
+		{
+			name:     "separate resources",
+			requests: []string{"a/1", "b/2", "a/3", "b/4", "c/5"},
+			want:     []string{"a/1/0", "a/3/1", "b/2/0", "b/4/1", "c/5/0"},
+		},
+		{
+			name:     "retried request",
+			requests: []string{"a/1", "a/1"},
+			want:     []string{"a/1/0"},
+		},
+		{
+			name:     "retried suppressed request",
+			requests: []string{"a/1", "a/2", "a/2", "a/3"},
+			want:     []string{"a/1/0", "a/3/2"},
+		},
+		{
+			name:     "requests without UID",
+			requests: []string{"a/", "a/", "a/"},
+			want:     []string{"a//0", "a//2"},
+		},
+		{
+			name:     "failed request",
+			requests: []string{"a/1", "a/2", "a/3"},
+			failing:  []types.UID{"1"},
+			want:     []string{"a/2/0", "a/3/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{failing: make(map[types.UID]bool)}
+			for _, uid := range tt.failing {
+				sink.failing[uid] = true
+			}
+			// The windows outlast the test, Close publishes the pending requests.
+			s := newCoalescingSink(sink, testWindows(time.Hour, time.Hour), priority.Medium)
+			for _, request := range tt.requests {
+				name, uid, _ := strings.Cut(request, "/")
+				err := s.Publish(context.Background(), testCoalesceEvent(name, uid, ""))
+				if wantErr := sink.failing[types.UID(uid)]; (err != nil) != wantErr {
+					t.Errorf("Publish(%s) = %v, want error %t", request, err, wantErr)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			got := sink.summary()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+			if !sink.isClosed() {
+				t.Error("wrapped sink not closed")
+			}
+		})
+	}
+}
+
+func TestCoalescingSinkPriorityWindows(t *testing.T) {
+	sink := &recordingSink{}
+	s := newCoalescingSink(sink, testWindows(50*time.Millisecond, time.Hour), priority.Medium)
+	ctx := context.Background()
+	for _, event := range []*reconcile.Event{
+		testCoalesceEvent("critical", "1", "critical"),
+		testCoalesceEvent("low", "2", "low"),
+		testCoalesceEvent("critical", "3", "critical"),
+		testCoalesceEvent("low", "4", "low"),
+		// Resources without a valid priority label have the default priority.
+		testCoalesceEvent("default", "5", "invalid"),
+		testCoalesceEvent("default", "6", ""),
+	} {
+		if err := s.Publish(ctx, event); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	if got, want := sink.summary(), []string{"critical/1/0", "low/2/0", "default/5/0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("published %v before the windows ended, want %v", got, want)
+	}
+
+	// The critical window ends first, and its pending request opens the next window.
+	waitForPublished(t, sink, 4)
+	if got, want := sink.summary()[3], "critical/3/1"; got != want {
+		t.Errorf("published %s at the end of the critical window, want %s", got, want)
+	}
+	if err := s.Publish(ctx, testCoalesceEvent("critical", "7", "critical")); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if got := len(sink.summary()); got != 4 {
+		t.Errorf("published a request within the next critical window")
+	}
+	waitForPublished(t, sink, 5)
+	if got, want := sink.summary()[4], "critical/7/1"; got != want {
+		t.Errorf("published %s at the end of the next critical window, want %s", got, want)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	got := sink.summary()[5:]
+	sort.Strings(got)
+	if want := []string{"default/6/1", "low/4/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v on Close, want %v", got, want)
+	}
+}
+
+// testWindows returns coalescing windows of the given length for critical resources, and of the other length for the
+// other priorities.
+func testWindows(critical, other time.Duration) map[priority.Priority]time.Duration {
+	windows := make(map[priority.Priority]time.Duration)
+	for _, p := range priority.All {
+		windows[p] = other
+	}
+	windows[priority.Critical] = critical
+	return windows
+}
+
+func testCoalesceEvent(name, uid, prio string) *reconcile.Event {
+	return &reconcile.Event{
+		Name: name, Namespace: "team-a", Kind: "Deployment", Group: "apps", Version: "v1",
+		RequestUID: types.UID(uid), Priority: prio,
+	}
+}
+
+// waitForPublished waits until the sink received the given number of requests.
+func waitForPublished(t *testing.T, sink *recordingSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.summary()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("published %v, want %d requests", sink.summary(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// recordingSink records the published events, failing those whose request UID is in failing.
+type recordingSink struct {
+	failing map[types.UID]bool
+
+	mu     sync.Mutex
+	events []*reconcile.Event
+	closed bool
+}
+
+func (s *recordingSink) Publish(_ context.Context, event *reconcile.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing[event.RequestUID] {
+		return errors.New("sink unavailable")
+	}
+	published := *event
+	s.events = append(s.events, &published)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// published returns the published events.
+func (s *recordingSink) published() []*reconcile.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*reconcile.Event(nil), s.events...)
+}
+
+// summary returns the published events as name/request UID/suppressed, in order.
+func (s *recordingSink) summary() []string {
+	var summary []string
+	for _, event := range s.published() {
+		summary = append(summary, fmt.Sprintf("%s/%s/%d", event.Name, event.RequestUID, event.Suppressed))
+	}
+	return summary
+}
+
+func (s *recordingSink) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/env"
+	"github.com/stackrox/admission-controller-heimdall/internal/kafkaclient"
+	"github.com/stackrox/admission-controller-heimdall/internal/message"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	"time"
+)
+
+// config holds the runtime configuration of the admission controller. It is read from environment variables, which
+// are set in deployment/deployment.yaml.
+type config struct {
+	// allowGarbageCollectorDeletes permits the garbage collector to delete owned resources that have ownerReferences,
+	// i.e., dependents that are removed in a cascade because their parent was deleted.
+	allowGarbageCollectorDeletes bool
+
+	// autoOwnerNamespaces are the namespaces in which newly created resources are stamped with their creator as owner.
+	autoOwnerNamespaces map[string]bool
+	// autoOwnerPrincipals are the principals whose newly created resources are stamped with their creator as owner,
+	// in any namespace.
+	autoOwnerPrincipals []owner
+	// reconcilerPrincipals are the principals of reconcilers, which may change the protected fields of any owned
+	// resource to restore its owner-approved state, but not its ownership.
+	reconcilerPrincipals []owner
+	// autoOwnerPriority is the priority label value added to stamped resources that do not set one.
+	autoOwnerPriority priority.Priority
+	// defaultPriority is the priority of resources without a valid priority label.
+	defaultPriority priority.Priority
+
+	// defaultEnforcement is the enforcement mode for owned resources not selected by any HeimdallPolicy.
+	defaultEnforcement enforcementMode
+
+	// sinks are the backends reconcile requests are published to.
+	sinks []sinkKind
+	// httpSinkURL is the endpoint the http sink POSTs reconcile requests to.
+	httpSinkURL string
+	// httpSinkTimeout bounds each request of the http sink.
+	httpSinkTimeout time.Duration
+	// fileSinkPath is the JSON-lines file the file sink appends reconcile requests to.
+	fileSinkPath string
+	// coalesce enables coalescing the reconcile requests for a resource within the window of its priority.
+	coalesce        bool
+	coalesceWindows map[priority.Priority]time.Duration
+
+	// kafkaEncoding determines how reconcile events are encoded in Kafka messages.
+	kafkaEncoding message.Encoding
+	// kafkaPriorityTopics routes reconcile requests to a topic per priority instead of the Heimdall topic.
+	kafkaPriorityTopics bool
+	// kafka holds the settings for connecting to Kafka, shared with the reconciler.
+	kafka kafkaclient.Config
+
+	// kafkaAcks determines which brokers have to acknowledge a Kafka message.
+	kafkaAcks acks
+	// kafkaIdempotent enables the idempotent producer, which avoids duplicates when retrying.
+	kafkaIdempotent bool
+	// kafkaRetryMax is how often the producer retries sending a message.
+	kafkaRetryMax int
+	// kafkaRetryBackoff is how long the producer waits between retries.
+	kafkaRetryBackoff time.Duration
+	// kafkaWaitForDelivery makes admissions wait for the brokers to acknowledge their reconcile requests, or for the
+	// spool to take them, failing the admissions in enforce and revert mode if neither does.
+	kafkaWaitForDelivery bool
+	// kafkaDeliveryTimeout bounds waiting for the acknowledgement of a message, in addition to the admission deadline.
+	kafkaDeliveryTimeout time.Duration
+	// kafkaMessageKey determines the key of Kafka messages, and thereby which events are consumed in order.
+	kafkaMessageKey messageKey
+	// kafkaPartitioner determines how Kafka messages are assigned to partitions.
+	kafkaPartitioner partitioner
+	// kafkaTopicProvisioning determines how the Heimdall topic is provisioned, with the settings kafkaTopic.
+	kafkaTopicProvisioning topicProvisioning
+	kafkaTopic             topicSettings
+	// kafkaRefreshInterval is how often the Kafka broker list is resolved, reconnecting the producer if it changed.
+	kafkaRefreshInterval time.Duration
+
+	// queueSize is the capacity of the in-process queue of reconcile requests waiting to be published.
+	queueSize int
+	// queueWorkers is the number of workers handing queued reconcile requests to the producer.
+	queueWorkers int
+	// queueFullPolicy determines what happens to reconcile requests published while the queue is full.
+	queueFullPolicy queueFullPolicy
+	// queueBlockTimeout is how long the block policy waits for room in the queue.
+	queueBlockTimeout time.Duration
+
+	// spoolDir is the directory of the spool for reconcile requests that cannot be delivered to Kafka. Spooling is
+	// disabled if it is empty.
+	spoolDir string
+	// spoolMaxBytes is the size limit of the spool, beyond which its oldest requests are dropped.
+	spoolMaxBytes int
+
+	// snapshotStore is the backend the snapshots of owner-approved states are recorded in, with the namespace of the
+	// configmap and secret stores and the directory of the file store.
+	snapshotStore     snapshotStoreKind
+	snapshotNamespace string
+	snapshotDir       string
+	// snapshotMaxEntries and snapshotMaxAge are the retention limits of the snapshot store, enforced every
+	// snapshotPruneInterval.
+	snapshotMaxEntries    int
+	snapshotMaxAge        time.Duration
+	snapshotPruneInterval time.Duration
+
+	// metricsAddr is the address the metrics are served on over plain HTTP.
+	metricsAddr string
+}
+
+// loadConfig reads the configuration from the environment, applying defaults for unset variables.
+func loadConfig() (*config, error) {
+	cfg := &config{}
+	var err error
+
+	if cfg.allowGarbageCollectorDeletes, err = env.Bool("HEIMDALL_ALLOW_GARBAGE_COLLECTOR_DELETES", true); err != nil {
+		return nil, err
+	}
+
+	cfg.autoOwnerNamespaces = make(map[string]bool)
+	for _, ns := range env.List("HEIMDALL_AUTO_OWNER_NAMESPACES", nil) {
+		cfg.autoOwnerNamespaces[ns] = true
+	}
+	for _, ref := range env.List("HEIMDALL_AUTO_OWNER_PRINCIPALS", nil) {
+		principal, err := parseOwner(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for HEIMDALL_AUTO_OWNER_PRINCIPALS: %v", err)
+		}
+		cfg.autoOwnerPrincipals = append(cfg.autoOwnerPrincipals, principal)
+	}
+	for _, ref := range env.List("HEIMDALL_RECONCILER_PRINCIPALS", nil) {
+		principal, err := parseOwner(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for HEIMDALL_RECONCILER_PRINCIPALS: %v", err)
+		}
+		cfg.reconcilerPrincipals = append(cfg.reconcilerPrincipals, principal)
+	}
+	if v := env.String("HEIMDALL_AUTO_OWNER_PRIORITY", ""); v != "" {
+		if cfg.autoOwnerPriority, err = priority.Parse(v); err != nil {
+			return nil, fmt.Errorf("invalid value for HEIMDALL_AUTO_OWNER_PRIORITY: %v", err)
+		}
+	}
+	if cfg.defaultPriority, err = priority.Parse(env.String("HEIMDALL_DEFAULT_PRIORITY", string(priority.Medium))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_DEFAULT_PRIORITY: %v", err)
+	}
+
+	if cfg.defaultEnforcement, err = parseEnforcementMode(env.String("HEIMDALL_DEFAULT_ENFORCEMENT", string(enforcementEnforce))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_DEFAULT_ENFORCEMENT: %v", err)
+	}
+
+	for _, name := range env.List("HEIMDALL_SINKS", []string{string(sinkKafka)}) {
+		kind, err := parseSinkKind(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for HEIMDALL_SINKS: %v", err)
+		}
+		cfg.sinks = append(cfg.sinks, kind)
+	}
+	cfg.httpSinkURL = env.String("HEIMDALL_HTTP_SINK_URL", "")
+	if cfg.httpSinkTimeout, err = env.Duration("HEIMDALL_HTTP_SINK_TIMEOUT", 2*time.Second); err != nil {
+		return nil, err
+	}
+	cfg.fileSinkPath = env.String("HEIMDALL_FILE_SINK_PATH", "")
+	for _, kind := range cfg.sinks {
+		if kind == sinkHTTP && cfg.httpSinkURL == "" {
+			return nil, fmt.Errorf("HEIMDALL_HTTP_SINK_URL is required for the %s sink", sinkHTTP)
+		}
+		if kind == sinkFile && cfg.fileSinkPath == "" {
+			return nil, fmt.Errorf("HEIMDALL_FILE_SINK_PATH is required for the %s sink", sinkFile)
+		}
+	}
+
+	if cfg.coalesce, err = env.Bool("HEIMDALL_COALESCE", true); err != nil {
+		return nil, err
+	}
+	coalesceWindow, err := env.Duration("HEIMDALL_COALESCE_WINDOW", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.coalesceWindows, err = parsePriorityDurations(env.List("HEIMDALL_COALESCE_PRIORITY_WINDOWS", nil)); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_COALESCE_PRIORITY_WINDOWS: %v", err)
+	}
+	for _, p := range priority.All {
+		if _, ok := cfg.coalesceWindows[p]; !ok {
+			cfg.coalesceWindows[p] = coalesceWindow
+		}
+	}
+
+	if cfg.kafkaEncoding, err = message.ParseEncoding(env.String("HEIMDALL_KAFKA_ENCODING", string(message.EncodingJSON))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_KAFKA_ENCODING: %v", err)
+	}
+	if cfg.kafkaPriorityTopics, err = env.Bool("HEIMDALL_KAFKA_PRIORITY_TOPICS", false); err != nil {
+		return nil, err
+	}
+	if cfg.kafka, err = kafkaclient.LoadConfig(); err != nil {
+		return nil, err
+	}
+
+	if cfg.kafkaAcks, err = parseAcks(env.String("HEIMDALL_KAFKA_ACKS", string(acksAll))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_KAFKA_ACKS: %v", err)
+	}
+	if cfg.kafkaIdempotent, err = env.Bool("HEIMDALL_KAFKA_IDEMPOTENT", true); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaIdempotent && cfg.kafkaAcks != acksAll {
+		return nil, fmt.Errorf("HEIMDALL_KAFKA_IDEMPOTENT requires HEIMDALL_KAFKA_ACKS to be %s", acksAll)
+	}
+	if cfg.kafkaRetryMax, err = env.NonNegativeInt("HEIMDALL_KAFKA_RETRY_MAX", 3); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaIdempotent && cfg.kafkaRetryMax == 0 {
+		return nil, fmt.Errorf("HEIMDALL_KAFKA_IDEMPOTENT requires HEIMDALL_KAFKA_RETRY_MAX to be at least 1")
+	}
+	if cfg.kafkaRetryBackoff, err = env.Duration("HEIMDALL_KAFKA_RETRY_BACKOFF", 100*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaWaitForDelivery, err = env.Bool("HEIMDALL_KAFKA_WAIT_FOR_DELIVERY", true); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaDeliveryTimeout, err = env.Duration("HEIMDALL_KAFKA_DELIVERY_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaMessageKey, err = parseMessageKey(env.String("HEIMDALL_KAFKA_MESSAGE_KEY", string(messageKeyUID))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_KAFKA_MESSAGE_KEY: %v", err)
+	}
+	if cfg.kafkaPartitioner, err = parsePartitioner(env.String("HEIMDALL_KAFKA_PARTITIONER", string(partitionerHash))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_KAFKA_PARTITIONER: %v", err)
+	}
+	if cfg.kafkaTopicProvisioning, err = parseTopicProvisioning(env.String("HEIMDALL_KAFKA_TOPIC_PROVISIONING", string(topicProvisioningAdmin))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_KAFKA_TOPIC_PROVISIONING: %v", err)
+	}
+	if cfg.kafkaTopic.partitions, err = env.Int("HEIMDALL_KAFKA_TOPIC_PARTITIONS", 2); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaTopic.replicationFactor, err = env.Int("HEIMDALL_KAFKA_TOPIC_REPLICATION_FACTOR", 1); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaTopic.retention, err = env.Duration("HEIMDALL_KAFKA_TOPIC_RETENTION", 7*24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaTopic.cleanupPolicy, err = parseCleanupPolicy(env.String("HEIMDALL_KAFKA_TOPIC_CLEANUP_POLICY", "delete")); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_KAFKA_TOPIC_CLEANUP_POLICY: %v", err)
+	}
+	if cfg.kafkaTopic.minInSyncReplicas, err = env.Int("HEIMDALL_KAFKA_TOPIC_MIN_INSYNC_REPLICAS", 1); err != nil {
+		return nil, err
+	}
+	if cfg.kafkaTopic.minInSyncReplicas > cfg.kafkaTopic.replicationFactor {
+		return nil, fmt.Errorf("HEIMDALL_KAFKA_TOPIC_MIN_INSYNC_REPLICAS must not exceed HEIMDALL_KAFKA_TOPIC_REPLICATION_FACTOR")
+	}
+	if cfg.kafkaRefreshInterval, err = env.Duration("HEIMDALL_KAFKA_REFRESH_INTERVAL", 30*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.queueSize, err = env.Int("HEIMDALL_QUEUE_SIZE", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.queueWorkers, err = env.Int("HEIMDALL_QUEUE_WORKERS", 2); err != nil {
+		return nil, err
+	}
+	if cfg.queueFullPolicy, err = parseQueueFullPolicy(env.String("HEIMDALL_QUEUE_FULL_POLICY", string(queueFullBlock))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_QUEUE_FULL_POLICY: %v", err)
+	}
+	if cfg.queueBlockTimeout, err = env.Duration("HEIMDALL_QUEUE_BLOCK_TIMEOUT", 2*time.Second); err != nil {
+		return nil, err
+	}
+
+	cfg.spoolDir = env.String("HEIMDALL_SPOOL_DIR", "")
+	if cfg.spoolMaxBytes, err = env.Int("HEIMDALL_SPOOL_MAX_BYTES", 100<<20); err != nil {
+		return nil, err
+	}
+
+	if cfg.snapshotStore, err = parseSnapshotStoreKind(env.String("HEIMDALL_SNAPSHOT_STORE", string(snapshotStoreConfigMap))); err != nil {
+		return nil, fmt.Errorf("invalid value for HEIMDALL_SNAPSHOT_STORE: %v", err)
+	}
+	cfg.snapshotNamespace = env.String("HEIMDALL_SNAPSHOT_NAMESPACE", "heimdall")
+	cfg.snapshotDir = env.String("HEIMDALL_SNAPSHOT_DIR", "/var/lib/heimdall/snapshots")
+	if cfg.snapshotMaxEntries, err = env.Int("HEIMDALL_SNAPSHOT_MAX_ENTRIES", 10000); err != nil {
+		return nil, err
+	}
+	if cfg.snapshotMaxAge, err = env.Duration("HEIMDALL_SNAPSHOT_MAX_AGE", 30*24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.snapshotPruneInterval, err = env.Duration("HEIMDALL_SNAPSHOT_PRUNE_INTERVAL", 10*time.Minute); err != nil {
+		return nil, err
+	}
+
+	cfg.metricsAddr = env.String("HEIMDALL_METRICS_ADDR", ":8080")
+
+	return cfg, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/jsonpointer"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+const (
+	// enforcementLabel on a namespace tightens the enforcement mode of all policies for the resources in it. It cannot
+	// loosen it, as anyone allowed to label the namespace could otherwise disable the protection of its resources.
+	enforcementLabel = `app.heimdall.io/enforcement`
+)
+
+// enforcementMode determines what happens to a request by a non-owner that violates the protection of a resource. In
+// all modes, the violation is logged and the resource is queued for reconciliation.
+type enforcementMode string
+
+const (
+	// enforcementEnforce denies the request.
+	enforcementEnforce enforcementMode = "enforce"
+	// enforcementWarn allows the request, returning a warning to the client.
+	enforcementWarn enforcementMode = "warn"
+	// enforcementAudit allows the request silently.
+	enforcementAudit enforcementMode = "audit"
+	// enforcementRevert allows the request, but patches the protected values it changed back to their previous
+	// values, returning a warning to the client. Deletions cannot be reverted and are denied.
+	enforcementRevert enforcementMode = "revert"
+)
+
+// revertEventReason is the reason of the Kubernetes Events recorded for reverted changes.
+const revertEventReason = "ChangesReverted"
+
+func parseEnforcementMode(s string) (enforcementMode, error) {
+	switch mode := enforcementMode(s); mode {
+	case enforcementEnforce, enforcementRevert, enforcementWarn, enforcementAudit:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid enforcement mode %q, must be one of %s, %s, %s or %s", s,
+		enforcementEnforce, enforcementRevert, enforcementWarn, enforcementAudit)
+}
+
+// strictness orders the enforcement modes, so that the strictest one wins when several policies apply.
+func (m enforcementMode) strictness() int {
+	switch m {
+	case enforcementEnforce:
+		return 3
+	case enforcementRevert:
+		return 2
+	case enforcementWarn:
+		return 1
+	}
+	return 0
+}
+
+// handleViolation publishes the given reconcile event, unless the request is a dry run, and applies the enforcement
+// mode of its protection to a violation by the requesting user, described by violation (e.g. "cannot delete resource").
+// revertOps are the patch operations reverting the violating changes, they are nil if the request cannot be reverted,
+// which the revert mode denies. If the event is lost, the enforce and revert modes fail the admission, so that no
+// violation goes without a reconcile request; the warn and audit modes let the request through regardless.
+func (h *heimdall) handleViolation(ctx context.Context, req *admissionRequest, prot *protection, event *reconcile.Event, patchOps, revertOps []patchOperation, violation string) ([]patchOperation, []string, error) {
+	requester := describeUser(req.UserInfo)
+	message := fmt.Sprintf("non-owner %s %s", requester, violation)
+	event.Reason = message
+
+	// Dry-run requests are evaluated like any other, but must not have side effects such as triggering a reconcile.
+	outcome := "resource queued for Reconcile"
+	if req.DryRun {
+		outcome = "dry run, resource not queued for Reconcile"
+	} else if err := h.publishReconcile(ctx, event); err != nil {
+		if prot.mode.strictness() >= enforcementRevert.strictness() {
+			return nil, nil, err
+		}
+		outcome = fmt.Sprintf("failed to queue resource for Reconcile: %v", err)
+	}
+
+	switch prot.mode {
+	case enforcementRevert:
+		if revertOps == nil {
+			break
+		}
+		revertedPaths := make([]string, 0, len(revertOps))
+		for _, op := range revertOps {
+			revertedPaths = append(revertedPaths, op.Path)
+		}
+		reverted := summarizePaths(revertedPaths)
+		logrus.Warnf("REVERTED: %s (%s, revert mode), changes to %s reverted, %s", message, prot, reverted, outcome)
+		if !req.DryRun {
+			h.recordEvent(event, revertEventReason, fmt.Sprintf("%s, changes to %s reverted", message, reverted))
+		}
+		return append(patchOps, revertOps...), []string{fmt.Sprintf("Heimdall: %s; the changes to %s were reverted", message, reverted)}, nil
+	case enforcementWarn:
+		logrus.Warnf("WARNED: %s (%s, warn mode), %s", message, prot, outcome)
+		return patchOps, []string{fmt.Sprintf("Heimdall: %s; the change will be reconciled", message)}, nil
+	case enforcementAudit:
+		logrus.Warnf("AUDITED: %s (%s, audit mode), %s", message, prot, outcome)
+		return patchOps, nil, nil
+	}
+	logrus.Warnf("DENIED: %s (%s), %s", message, prot, outcome)
+	return nil, nil, fmt.Errorf("DENIED: %s", message)
+}
+
+// recordEvent records a Kubernetes Event on the resource of the given reconcile event in the background, so that the
+// admission does not wait for it.
+func (h *heimdall) recordEvent(event *reconcile.Event, reason, message string) {
+	if h.clientset == nil {
+		return
+	}
+	go func() {
+		if err := createEvent(context.Background(), h.clientset, event, reason, message); err != nil {
+			logrus.Errorf("failed to record %s event for resource %s/%s: %v", reason, event.Namespace, event.Name, err)
+		}
+	}()
+}
+
+// revertPatch returns the patch operations that put the values at the given JSON pointers of newObj back to their
+// values in existingObj, leaving all other values as the request set them. Pointers nested in other pointers are
+// covered by those. Objects and arrays are reverted value by value: array elements the request appended are removed,
+// highest index first, and those it removed are added back in order. Values the request removed along with their
+// parent are added back with the parent, which only holds the reverted values if it is an object.
+func revertPatch(existingObj, newObj map[string]interface{}, pointers []string) []patchOperation {
+	var paths [][]string
+	for _, pointer := range pointers {
+		if tokens, err := jsonpointer.Parse(pointer); err == nil && len(tokens) > 0 {
+			paths = append(paths, tokens)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return jsonpointer.Compare(paths[i], paths[j]) < 0 })
+
+	var changes []revertChange
+	var covered []string
+	for _, tokens := range paths {
+		pointer := jsonpointer.Join(tokens)
+		if jsonpointer.IsUnderAny(pointer, covered) {
+			continue
+		}
+		covered = append(covered, pointer)
+		oldValue, hadOld := jsonpointer.Lookup(existingObj, tokens)
+		newValue, hasNew := jsonpointer.Lookup(newObj, tokens)
+		changes = revertChanges(oldValue, hadOld, newValue, hasNew, tokens, changes)
+	}
+
+	// Replacements do not move other values. Removing array elements shifts the elements after them, and adding them
+	// back requires the elements before them.
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].op != changes[j].op {
+			return revertOpOrder[changes[i].op] < revertOpOrder[changes[j].op]
+		}
+		if changes[i].op == "remove" {
+			return jsonpointer.Compare(changes[i].tokens, changes[j].tokens) > 0
+		}
+		return jsonpointer.Compare(changes[i].tokens, changes[j].tokens) < 0
+	})
+
+	var patchOps []patchOperation
+	var added []revertChange
+	exists := func(tokens []string) bool {
+		if _, ok := jsonpointer.Lookup(newObj, tokens); ok {
+			return true
+		}
+		for _, add := range added {
+			if len(tokens) >= len(add.tokens) && jsonpointer.Compare(tokens[:len(add.tokens)], add.tokens) == 0 {
+				if _, ok := jsonpointer.Lookup(add.value, tokens[len(add.tokens):]); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, change := range changes {
+		if change.op == "add" {
+			change = parentAdd(existingObj, change, exists)
+			added = append(added, change)
+		}
+		patchOps = append(patchOps, patchOperation{Op: change.op, Path: jsonpointer.Join(change.tokens), Value: change.value})
+	}
+	return patchOps
+}
+
+// revertChange is a patch operation of revertPatch, with its path as reference tokens.
+type revertChange struct {
+	op     string
+	tokens []string
+	value  interface{}
+}
+
+// revertOpOrder is the order in which revertPatch applies its operations.
+var revertOpOrder = map[string]int{"replace": 0, "remove": 1, "add": 2}
+
+// revertChanges appends the changes that put the value at the given reference tokens back from newValue to oldValue,
+// descending into objects and arrays so that only the values that differ are changed.
+func revertChanges(oldValue interface{}, hadOld bool, newValue interface{}, hasNew bool, tokens []string, changes []revertChange) []revertChange {
+	switch {
+	case hadOld && hasNew:
+	case hadOld:
+		return append(changes, revertChange{op: "add", tokens: tokens, value: oldValue})
+	case hasNew:
+		return append(changes, revertChange{op: "remove", tokens: tokens})
+	default:
+		return changes
+	}
+
+	switch oldV := oldValue.(type) {
+	case map[string]interface{}:
+		newV, ok := newValue.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(oldV)+len(newV))
+		for k := range oldV {
+			keys = append(keys, k)
+		}
+		for k := range newV {
+			if _, ok := oldV[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			oldChild, hadOldChild := oldV[k]
+			newChild, hasNewChild := newV[k]
+			changes = revertChanges(oldChild, hadOldChild, newChild, hasNewChild, childTokens(tokens, k), changes)
+		}
+		return changes
+
+	case []interface{}:
+		newV, ok := newValue.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(oldV) || i < len(newV); i++ {
+			var oldChild, newChild interface{}
+			if i < len(oldV) {
+				oldChild = oldV[i]
+			}
+			if i < len(newV) {
+				newChild = newV[i]
+			}
+			changes = revertChanges(oldChild, i < len(oldV), newChild, i < len(newV), childTokens(tokens, strconv.Itoa(i)), changes)
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(oldValue, newValue) {
+		changes = append(changes, revertChange{op: "replace", tokens: tokens, value: oldValue})
+	}
+	return changes
+}
+
+// parentAdd returns the change adding back a value whose parents the request may have removed as well: it adds the
+// highest missing parent instead, holding only the value. Array elements cannot be restored partially, so if a missing
+// parent is an array element, it is added back whole.
+func parentAdd(existingObj map[string]interface{}, change revertChange, exists func(tokens []string) bool) revertChange {
+	tokens := change.tokens
+	k := len(tokens) - 1
+	for k > 0 && !exists(tokens[:k]) {
+		k--
+	}
+	if k == len(tokens)-1 {
+		return change
+	}
+
+	value := change.value
+	for i := len(tokens) - 1; i > k; i-- {
+		value = map[string]interface{}{tokens[i]: value}
+	}
+	for i := k; i < len(tokens); i++ {
+		if parent, _ := jsonpointer.Lookup(existingObj, tokens[:i]); !isJSONObject(parent) {
+			value, _ = jsonpointer.Lookup(existingObj, tokens[:k+1])
+			break
+		}
+	}
+	return revertChange{op: "add", tokens: tokens[:k+1], value: value}
+}
+
+func isJSONObject(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
+// childTokens returns the reference tokens of the given child of the value at tokens.
+func childTokens(tokens []string, child string) []string {
+	return append(append(make([]string, 0, len(tokens)+1), tokens...), child)
+}
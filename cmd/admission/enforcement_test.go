@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/jsonpointer"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestRevertPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		new      string
+		pointers []string
+		// want is new with the patch applied.
+		want string
+		// wantOps are the expected operations, if their order matters.
+		wantOps []patchOperation
+		// wantPatch is the expected encoding of the patch, if set.
+		wantPatch string
+	}{
+		{
+			name:     "changed value",
+			existing: `{"spec":{"replicas":1,"paused":false}}`,
+			new:      `{"spec":{"replicas":3,"paused":true}}`,
+			pointers: []string{"/spec/replicas"},
+			want:     `{"spec":{"replicas":1,"paused":true}}`,
+		},
+		{
+			name:     "added and removed values",
+			existing: `{"spec":{"a":1}}`,
+			new:      `{"spec":{"b":2}}`,
+			pointers: []string{"/spec/a", "/spec/b"},
+			want:     `{"spec":{"a":1}}`,
+		},
+		{
+			name:     "nested maps",
+			existing: `{"spec":{"template":{"metadata":{"labels":{"app":"web","tier":"front"}}}}}`,
+			new:      `{"spec":{"template":{"metadata":{"labels":{"app":"api","team":"x"}}}}}`,
+			pointers: []string{"/spec/template/metadata/labels"},
+			want:     `{"spec":{"template":{"metadata":{"labels":{"app":"web","tier":"front"}}}}}`,
+			wantOps: []patchOperation{
+				{Op: "replace", Path: "/spec/template/metadata/labels/app", Value: "web"},
+				{Op: "remove", Path: "/spec/template/metadata/labels/team"},
+				{Op: "add", Path: "/spec/template/metadata/labels/tier", Value: "front"},
+			},
+		},
+		{
+			name:     "pointers nested in other pointers",
+			existing: `{"spec":{"a":{"x":1,"y":1}}}`,
+			new:      `{"spec":{"a":{"x":2,"y":2}}}`,
+			pointers: []string{"/spec/a/x", "/spec/a"},
+			want:     `{"spec":{"a":{"x":1,"y":1}}}`,
+			wantOps: []patchOperation{
+				{Op: "replace", Path: "/spec/a/x", Value: 1.0},
+				{Op: "replace", Path: "/spec/a/y", Value: 1.0},
+			},
+		},
+		{
+			name:     "array growth",
+			existing: `{"spec":{"args":["a","b"]}}`,
+			new:      `{"spec":{"args":["a","x","c","d","e","f","g","h","i","j","k","l"]}}`,
+			pointers: []string{"/spec/args"},
+			want:     `{"spec":{"args":["a","b"]}}`,
+			wantOps: []patchOperation{
+				{Op: "replace", Path: "/spec/args/1", Value: "b"},
+				{Op: "remove", Path: "/spec/args/11"},
+				{Op: "remove", Path: "/spec/args/10"},
+				{Op: "remove", Path: "/spec/args/9"},
+				{Op: "remove", Path: "/spec/args/8"},
+				{Op: "remove", Path: "/spec/args/7"},
+				{Op: "remove", Path: "/spec/args/6"},
+				{Op: "remove", Path: "/spec/args/5"},
+				{Op: "remove", Path: "/spec/args/4"},
+				{Op: "remove", Path: "/spec/args/3"},
+				{Op: "remove", Path: "/spec/args/2"},
+			},
+		},
+		{
+			name:     "array shrink",
+			existing: `{"spec":{"args":["a","b","c","d","e","f","g","h","i","j","k","l"]}}`,
+			new:      `{"spec":{"args":["a"]}}`,
+			pointers: []string{"/spec/args"},
+			want:     `{"spec":{"args":["a","b","c","d","e","f","g","h","i","j","k","l"]}}`,
+		},
+		{
+			name:     "array of objects",
+			existing: `{"spec":{"containers":[{"name":"a","image":"a:1"},{"name":"b","image":"b:1"}]}}`,
+			new:      `{"spec":{"containers":[{"name":"a","image":"a:2"}]}}`,
+			pointers: []string{"/spec/containers"},
+			want:     `{"spec":{"containers":[{"name":"a","image":"a:1"},{"name":"b","image":"b:1"}]}}`,
+			wantOps: []patchOperation{
+				{Op: "replace", Path: "/spec/containers/0/image", Value: "a:1"},
+				{Op: "add", Path: "/spec/containers/1", Value: map[string]interface{}{"name": "b", "image": "b:1"}},
+			},
+		},
+		{
+			name:     "unprotected siblings of a changed value",
+			existing: `{"spec":{"a":{"x":1,"y":1}}}`,
+			new:      `{"spec":{"a":{"x":2,"y":2}}}`,
+			pointers: []string{"/spec/a/x"},
+			want:     `{"spec":{"a":{"x":1,"y":2}}}`,
+		},
+		{
+			name:     "unprotected siblings of a value removed with its parent",
+			existing: `{"spec":{"a":{"x":1,"y":1,"z":1}}}`,
+			new:      `{"spec":{}}`,
+			pointers: []string{"/spec/a/x", "/spec/a/z"},
+			want:     `{"spec":{"a":{"x":1,"z":1}}}`,
+			wantOps: []patchOperation{
+				{Op: "add", Path: "/spec/a", Value: map[string]interface{}{"x": 1.0}},
+				{Op: "add", Path: "/spec/a/z", Value: 1.0},
+			},
+		},
+		{
+			name:     "value removed with its grandparent",
+			existing: `{"metadata":{"labels":{"app.heimdall.io/owner":"jane","app":"web"}},"spec":{}}`,
+			new:      `{"spec":{}}`,
+			pointers: []string{"/metadata/labels/app.heimdall.io~1owner"},
+			want:     `{"metadata":{"labels":{"app.heimdall.io/owner":"jane"}},"spec":{}}`,
+		},
+		{
+			name:     "array element removed with its array",
+			existing: `{"spec":{"containers":[{"name":"a","image":"a:1"}]}}`,
+			new:      `{"spec":{}}`,
+			pointers: []string{"/spec/containers/0/image"},
+			want:     `{"spec":{"containers":[{"name":"a","image":"a:1"}]}}`,
+		},
+		{
+			name:      "null value",
+			existing:  `{"spec":{"a":null,"b":null}}`,
+			new:       `{"spec":{"a":1}}`,
+			pointers:  []string{"/spec/a", "/spec/b"},
+			want:      `{"spec":{"a":null,"b":null}}`,
+			wantPatch: `[{"op":"replace","path":"/spec/a","value":null},{"op":"add","path":"/spec/b","value":null}]`,
+		},
+		{
+			name:      "removed value",
+			existing:  `{"spec":{}}`,
+			new:       `{"spec":{"a":null}}`,
+			pointers:  []string{"/spec/a"},
+			want:      `{"spec":{}}`,
+			wantPatch: `[{"op":"remove","path":"/spec/a"}]`,
+		},
+		{
+			name:     "unchanged value",
+			existing: `{"spec":{"a":1}}`,
+			new:      `{"spec":{"a":1,"b":2}}`,
+			pointers: []string{"/spec/a", "/spec/c", ""},
+			want:     `{"spec":{"a":1,"b":2}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing, newObj := decodeTestJSON(t, tt.existing), decodeTestJSON(t, tt.new)
+			ops := revertPatch(existing, newObj, tt.pointers)
+			if tt.wantOps != nil && !reflect.DeepEqual(ops, tt.wantOps) {
+				t.Errorf("revertPatch = %+v, want %+v", ops, tt.wantOps)
+			}
+			patch, err := json.Marshal(ops)
+			if err != nil {
+				t.Fatalf("failed to encode %+v: %v", ops, err)
+			}
+			if tt.wantPatch != "" && string(patch) != tt.wantPatch {
+				t.Errorf("encoded patch = %s, want %s", patch, tt.wantPatch)
+			}
+			got, err := applyTestPatch(newObj, patch)
+			if err != nil {
+				t.Fatalf("failed to apply %s: %v", patch, err)
+			}
+			if want := decodeTestJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("patched object = %v, want %v (patch %+v)", got, want, ops)
+			}
+		})
+	}
+}
+
+func decodeTestJSON(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &doc); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", s, err)
+	}
+	return doc
+}
+
+// applyTestPatch applies the add, remove and replace operations of an encoded JSON patch to a copy of doc, in order.
+func applyTestPatch(doc map[string]interface{}, patch []byte) (map[string]interface{}, error) {
+	var ops []map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var patched interface{}
+	if err := json.Unmarshal(data, &patched); err != nil {
+		return nil, err
+	}
+	for _, encoded := range ops {
+		var op, path string
+		if err := json.Unmarshal(encoded["op"], &op); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(encoded["path"], &path); err != nil {
+			return nil, err
+		}
+		tokens, err := jsonpointer.Parse(path)
+		if err != nil || len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+		var value interface{}
+		if op != "remove" {
+			rawValue, ok := encoded["value"]
+			if !ok {
+				return nil, fmt.Errorf("%s %s: missing value", op, path)
+			}
+			if err := json.Unmarshal(rawValue, &value); err != nil {
+				return nil, err
+			}
+		}
+		if patched, err = applyTestOperation(patched, tokens, op, value); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", op, path, err)
+		}
+	}
+	return patched.(map[string]interface{}), nil
+}
+
+func applyTestOperation(doc interface{}, tokens []string, op string, value interface{}) (interface{}, error) {
+	token := tokens[0]
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		child, ok := v[token]
+		if len(tokens) > 1 {
+			if !ok {
+				return nil, fmt.Errorf("missing parent %q", token)
+			}
+			child, err := applyTestOperation(child, tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			v[token] = child
+			return v, nil
+		}
+		switch {
+		case op == "add":
+			v[token] = value
+		case !ok:
+			return nil, fmt.Errorf("missing value %q", token)
+		case op == "replace":
+			v[token] = value
+		case op == "remove":
+			delete(v, token)
+		}
+		return v, nil
+
+	case []interface{}:
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i > len(v) || (i == len(v) && (op != "add" || len(tokens) > 1)) {
+			return nil, fmt.Errorf("invalid index %q", token)
+		}
+		if len(tokens) > 1 {
+			if v[i], err = applyTestOperation(v[i], tokens[1:], op, value); err != nil {
+				return nil, err
+			}
+			return v, nil
+		}
+		switch op {
+		case "add":
+			return append(v[:i], append([]interface{}{value}, v[i:]...)...), nil
+		case "replace":
+			v[i] = value
+		case "remove":
+			return append(v[:i], v[i+1:]...), nil
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("cannot apply %s below a %T", op, doc)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kafka "github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/kafkaclient"
+	"github.com/stackrox/admission-controller-heimdall/internal/message"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"hash/crc32"
+	"k8s.io/client-go/dynamic"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errProducerNotConnected = errors.New("not connected to Kafka")
+	errDeliveryTimeout      = errors.New("timed out waiting for Kafka to acknowledge the reconcile request")
+	errProducerBusy         = errors.New("timed out handing the reconcile request to the Kafka producer")
+)
+
+// kafkaMessage is a message for the Heimdall topic. It is encoded as JSON in the spool.
+type kafkaMessage struct {
+	// Topic overrides the Heimdall topic, when routing by priority.
+	Topic   string           `json:",omitempty"`
+	Key     []byte           `json:",omitempty"`
+	Headers []message.Header `json:",omitempty"`
+	Value   []byte
+	// Priority is the priority of the reconcile request, which determines the order in which the spool is replayed.
+	Priority priority.Priority `json:",omitempty"`
+
+	// done is called with the delivery result of the message, if set. It is not spooled.
+	done deliveryCallback
+}
+
+// topic returns the topic the message is published to.
+func (m *kafkaMessage) topic() string {
+	if m.Topic != "" {
+		return m.Topic
+	}
+	return priority.Topic
+}
+
+// delivered reports the delivery result of the message, nil once the brokers acknowledged it.
+func (m *kafkaMessage) delivered(err error) {
+	if m.done != nil {
+		m.done(err)
+	}
+}
+
+// acks determines which brokers have to acknowledge a Kafka message before it counts as delivered.
+type acks string
+
+const (
+	// acksNone does not wait for any acknowledgement.
+	acksNone acks = "none"
+	// acksLeader waits for the partition leader to write the message.
+	acksLeader acks = "leader"
+	// acksAll waits for all in-sync replicas to write the message.
+	acksAll acks = "all"
+)
+
+func parseAcks(s string) (acks, error) {
+	switch a := acks(s); a {
+	case acksNone, acksLeader, acksAll:
+		return a, nil
+	}
+	return "", fmt.Errorf("invalid acks %q, must be one of %s, %s or %s", s, acksNone, acksLeader, acksAll)
+}
+
+func (a acks) requiredAcks() kafka.RequiredAcks {
+	switch a {
+	case acksNone:
+		return kafka.NoResponse
+	case acksLeader:
+		return kafka.WaitForLocal
+	}
+	return kafka.WaitForAll
+}
+
+// messageKey determines the key of the Kafka messages of reconcile events. Messages with the same key land on the same
+// partition, so that the events of a resource are consumed in order, and compacted topics keep the latest event of
+// each resource.
+type messageKey string
+
+const (
+	// messageKeyUID keys messages by the UID of the resource.
+	messageKeyUID messageKey = "uid"
+	// messageKeyName keys messages by the group, version, kind, namespace and name of the resource.
+	messageKeyName messageKey = "name"
+)
+
+func parseMessageKey(s string) (messageKey, error) {
+	switch key := messageKey(s); key {
+	case messageKeyUID, messageKeyName:
+		return key, nil
+	}
+	return "", fmt.Errorf("invalid message key %q, must be one of %s or %s", s, messageKeyUID, messageKeyName)
+}
+
+// of returns the key of the message for the given event. Events without a UID are keyed by name.
+func (k messageKey) of(event *reconcile.Event) string {
+	if k == messageKeyUID && event.UID != "" {
+		return string(event.UID)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s", event.Group, event.Version, event.Kind, event.Namespace, event.Name)
+}
+
+// partitioner determines how Kafka messages are assigned to partitions.
+type partitioner string
+
+const (
+	// partitionerHash hashes the message key with FNV-1a.
+	partitionerHash partitioner = "hash"
+	// partitionerReferenceHash hashes the message key like the reference Java client.
+	partitionerReferenceHash partitioner = "reference-hash"
+	// partitionerCRC32 hashes the message key with CRC-32 (IEEE).
+	partitionerCRC32 partitioner = "crc32"
+	// partitionerRoundRobin ignores the message key and distributes messages evenly.
+	partitionerRoundRobin partitioner = "roundrobin"
+	// partitionerRandom ignores the message key and assigns partitions at random.
+	partitionerRandom partitioner = "random"
+)
+
+func parsePartitioner(s string) (partitioner, error) {
+	switch p := partitioner(s); p {
+	case partitionerHash, partitionerReferenceHash, partitionerCRC32, partitionerRoundRobin, partitionerRandom:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid partitioner %q, must be one of %s, %s, %s, %s or %s", s,
+		partitionerHash, partitionerReferenceHash, partitionerCRC32, partitionerRoundRobin, partitionerRandom)
+}
+
+func (p partitioner) constructor() kafka.PartitionerConstructor {
+	switch p {
+	case partitionerReferenceHash:
+		return kafka.NewReferenceHashPartitioner
+	case partitionerCRC32:
+		return kafka.NewCustomHashPartitioner(crc32.NewIEEE)
+	case partitionerRoundRobin:
+		return kafka.NewRoundRobinPartitioner
+	case partitionerRandom:
+		return kafka.NewRandomPartitioner
+	}
+	return kafka.NewHashPartitioner
+}
+
+// kafkaSink publishes reconcile requests to the Heimdall topic. It assembles the reconcile queue, the producer it feeds
+// and, if configured, the spool for requests that cannot be delivered.
+type kafkaSink struct {
+	encoding        message.Encoding
+	messageKey      messageKey
+	priorityTopics  bool
+	defaultPriority priority.Priority
+	waitForDelivery bool
+	deliveryTimeout time.Duration
+	spool           *prioritySpool
+	producer        *reconcileProducer
+	queue           *reconcileQueue
+}
+
+func newKafkaSink(cfg *config, client dynamic.Interface, stopCh <-chan struct{}) (*kafkaSink, error) {
+	s := &kafkaSink{
+		encoding:        cfg.kafkaEncoding,
+		messageKey:      cfg.kafkaMessageKey,
+		priorityTopics:  cfg.kafkaPriorityTopics,
+		defaultPriority: cfg.defaultPriority,
+		waitForDelivery: cfg.kafkaWaitForDelivery,
+		deliveryTimeout: cfg.kafkaDeliveryTimeout,
+	}
+	if cfg.spoolDir != "" {
+		var err error
+		if s.spool, err = openPrioritySpool(cfg.spoolDir, int64(cfg.spoolMaxBytes)); err != nil {
+			return nil, fmt.Errorf("failed to open reconcile spool: %v", err)
+		}
+	}
+	var err error
+	s.producer, err = newReconcileProducer(kafkaclient.NewBrokerDiscovery(client, &cfg.kafka, stopCh), newTopicProvisioner(cfg, client), cfg)
+	if err != nil {
+		if s.spool != nil {
+			_ = s.spool.Close()
+		}
+		return nil, err
+	}
+	s.queue = newReconcileQueue(s.producer, s.spool, cfg.queueSize, cfg.queueWorkers, cfg.queueFullPolicy, cfg.queueBlockTimeout)
+	return s, nil
+}
+
+// Publish queues the event for Kafka, with the priority of the resource in a header and, if priorityTopics is set, on
+// the topic of that priority. If waitForDelivery is set, it waits for the brokers to acknowledge the message, or for
+// the spool to take it, up to the delivery timeout or until the context is done, so that the admission learns if the
+// event was lost.
+func (s *kafkaSink) Publish(ctx context.Context, event *reconcile.Event) error {
+	headers, value, err := message.Encode(event, s.encoding)
+	if err != nil {
+		return err
+	}
+	msg := &kafkaMessage{Key: []byte(s.messageKey.of(event)), Headers: headers, Value: value}
+	msg.Priority = eventPriority(event, s.defaultPriority)
+	msg.Headers = append(msg.Headers, message.Header{Key: priorityHeader, Value: string(msg.Priority)})
+	if s.priorityTopics {
+		msg.Topic = msg.Priority.Topic()
+	}
+	if !s.waitForDelivery {
+		return s.queue.enqueue(msg)
+	}
+
+	delivered := make(chan error, 1)
+	msg.done = func(err error) { delivered <- err }
+	if err := s.queue.enqueue(msg); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.deliveryTimeout)
+	defer cancel()
+	select {
+	case err := <-delivered:
+		return err
+	case <-ctx.Done():
+		return errDeliveryTimeout
+	}
+}
+
+// Close flushes the queued requests to Kafka, closes the producer and then the spool, which receives the requests the
+// producer fails to flush.
+func (s *kafkaSink) Close() error {
+	s.queue.Close(shutdownTimeout)
+	err := s.producer.Close()
+	if err != nil {
+		err = fmt.Errorf("failed to close Kafka producer: %v", err)
+	}
+	if s.spool != nil {
+		if spoolErr := s.spool.Close(); spoolErr != nil && err == nil {
+			err = fmt.Errorf("failed to close reconcile spool: %v", spoolErr)
+		}
+	}
+	return err
+}
+
+// reconcileProducer publishes reconcile requests to Kafka. It is created once at startup and shared by all admission
+// requests, so that connecting to the brokers and provisioning the topic stay out of the request path. In the
+// background, it periodically resolves the broker list and reconnects when the brokers change or the connection
+// broke.
+//
+// Messages are published asynchronously, their delivery results are logged and counted as they come in.
+type reconcileProducer struct {
+	discovery *kafkaclient.BrokerDiscovery
+	topic     *topicProvisioner
+	cfg       *config
+
+	// mu guards the producer: sends hold it for reading, so that a producer is never closed while in use.
+	mu       sync.RWMutex
+	producer kafka.AsyncProducer
+	brokers  []string
+	// securityFingerprint identifies the TLS and SASL material the producer was connected with.
+	securityFingerprint string
+	// broken is set when a send fails because the producer lost its connection to the brokers.
+	broken atomic.Bool
+	// topicVerified is when refresh last verified the topic.
+	topicVerified time.Time
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// newReconcileProducer creates the producer, provisioning the topic and making a first connection attempt before
+// returning. Failing to connect is not fatal, the producer keeps trying every kafkaRefreshInterval, but an existing
+// topic that does not match the configuration is. A topic that stops matching the configuration later disconnects the
+// producer until it is fixed, see refresh.
+func newReconcileProducer(discovery *kafkaclient.BrokerDiscovery, topic *topicProvisioner, cfg *config) (*reconcileProducer, error) {
+	p := &reconcileProducer{
+		discovery: discovery,
+		topic:     topic,
+		cfg:       cfg,
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	if err := p.refresh(); err != nil {
+		var mismatch *topicMismatchError
+		if errors.As(err, &mismatch) {
+			return nil, err
+		}
+		logrus.Errorf("failed to connect to Kafka: %v", err)
+	}
+	go p.run(cfg.kafkaRefreshInterval)
+	return p, nil
+}
+
+func (p *reconcileProducer) run(refreshInterval time.Duration) {
+	defer close(p.doneCh)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			if err := p.refresh(); err != nil {
+				logrus.Errorf("failed to refresh the Kafka connection: %v", err)
+			}
+		}
+	}
+}
+
+// refresh resolves the broker list and loads the TLS and SASL material, and (re)connects if there is no working
+// producer for them. This picks up rotated Secrets.
+//
+// The topic is provisioned before every (re)connection, and verified again every topicVerifyInterval while the
+// producer stays connected. If it no longer matches the configuration, e.g. because its partitions were changed out of band, publishing stops as it would at startup:
+// the producer is closed, and reconcile requests are spooled or fail until the topic is fixed, when the next refresh
+// reconnects. Failing to verify the topic otherwise leaves a working producer connected.
+func (p *reconcileProducer) refresh() error {
+	brokers, err := p.discovery.Brokers()
+	if err != nil {
+		return fmt.Errorf("failed to get broker list: %v", err)
+	}
+	brokers = append([]string(nil), brokers...)
+	sort.Strings(brokers)
+
+	security, err := kafkaclient.LoadSecurity(&p.cfg.kafka)
+	if err != nil {
+		return fmt.Errorf("failed to load Kafka credentials: %v", err)
+	}
+
+	p.mu.RLock()
+	upToDate := p.producer != nil && !p.broken.Load() && reflect.DeepEqual(brokers, p.brokers) &&
+		security.Fingerprint == p.securityFingerprint
+	p.mu.RUnlock()
+
+	config := newProducerConfig(p.cfg, security)
+	if !upToDate || time.Since(p.topicVerified) >= topicVerifyInterval {
+		if err := p.topic.ensure(brokers, config, security.Fingerprint); err != nil {
+			var mismatch *topicMismatchError
+			if errors.As(err, &mismatch) {
+				p.disconnect()
+			}
+			return err
+		}
+		p.topicVerified = time.Now()
+	}
+	if upToDate {
+		return nil
+	}
+
+	logrus.Infof("connecting to Kafka brokers %s", brokers)
+	producer, err := kafka.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka producer: %v", err)
+	}
+
+	go p.handleSuccesses(producer)
+	go p.handleErrors(producer)
+
+	p.mu.Lock()
+	previous := p.producer
+	p.producer, p.brokers, p.securityFingerprint = producer, brokers, security.Fingerprint
+	p.broken.Store(false)
+	p.mu.Unlock()
+
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			logrus.Warnf("failed to close previous Kafka producer: %v", err)
+		}
+	}
+	return nil
+}
+
+// disconnect closes the producer, so that nothing is published until refresh connects again.
+func (p *reconcileProducer) disconnect() {
+	p.mu.Lock()
+	producer := p.producer
+	p.producer, p.brokers, p.securityFingerprint = nil, nil, ""
+	p.mu.Unlock()
+
+	if producer != nil {
+		logrus.Errorf("disconnecting from Kafka until the topic matches the configuration")
+		if err := producer.Close(); err != nil {
+			logrus.Warnf("failed to close Kafka producer: %v", err)
+		}
+	}
+}
+
+// deliveryCallback is called with the delivery result of a message, nil once the brokers received it.
+type deliveryCallback func(error)
+
+// send hands the given message to the producer. It fails if the producer is not connected, or does not take the
+// message within the delivery timeout, e.g. because its buffers are full while the brokers are unreachable, so that
+// the caller can spool the message instead of blocking reconnects. Otherwise, done is called with the delivery
+// result, unless it is nil.
+func (p *reconcileProducer) send(msg *kafkaMessage, done deliveryCallback) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.producer == nil || p.broken.Load() {
+		return errProducerNotConnected
+	}
+
+	producerMsg := &kafka.ProducerMessage{
+		Topic:    msg.topic(),
+		Value:    kafka.ByteEncoder(msg.Value),
+		Metadata: done,
+	}
+	if msg.Key != nil {
+		producerMsg.Key = kafka.ByteEncoder(msg.Key)
+	}
+	for _, header := range msg.Headers {
+		producerMsg.Headers = append(producerMsg.Headers, kafka.RecordHeader{Key: []byte(header.Key), Value: []byte(header.Value)})
+	}
+
+	timer := time.NewTimer(p.cfg.kafkaDeliveryTimeout)
+	defer timer.Stop()
+	select {
+	case p.producer.Input() <- producerMsg:
+		return nil
+	case <-timer.C:
+		return errProducerBusy
+	case <-p.stopCh:
+		return errProducerNotConnected
+	}
+}
+
+// handleSuccesses consumes the delivery successes of the given producer until it is closed.
+func (p *reconcileProducer) handleSuccesses(producer kafka.AsyncProducer) {
+	for msg := range producer.Successes() {
+		metricKafkaSent.Add(1)
+		logrus.Infof("sent message to Kafka. Partition: %d, Offset: %d", msg.Partition, msg.Offset)
+		if done, ok := msg.Metadata.(deliveryCallback); ok && done != nil {
+			done(nil)
+		}
+	}
+}
+
+// handleErrors consumes the delivery errors of the given producer until it is closed.
+func (p *reconcileProducer) handleErrors(producer kafka.AsyncProducer) {
+	for err := range producer.Errors() {
+		metricKafkaFailed.Add(1)
+		logrus.Errorf("failed to send message to Kafka: %v", err.Err)
+		if errors.Is(err.Err, kafka.ErrOutOfBrokers) || errors.Is(err.Err, kafka.ErrClosedClient) {
+			p.broken.Store(true)
+		}
+		if done, ok := err.Msg.Metadata.(deliveryCallback); ok && done != nil {
+			done(err.Err)
+		}
+	}
+}
+
+// Close stops reconnecting and closes the producer, flushing any buffered messages, and the topic admin client.
+func (p *reconcileProducer) Close() error {
+	close(p.stopCh)
+	<-p.doneCh
+	p.topic.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.producer == nil {
+		return nil
+	}
+	err := p.producer.Close()
+	p.producer = nil
+	return err
+}
+
+// newProducerConfig returns the client configuration of the producer, which is also used to provision the topic.
+func newProducerConfig(cfg *config, security *kafkaclient.Security) *kafka.Config {
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.RequiredAcks = cfg.kafkaAcks.requiredAcks()
+	config.Producer.Timeout = cfg.kafkaDeliveryTimeout
+	config.Producer.Retry.Max = cfg.kafkaRetryMax
+	config.Producer.Retry.Backoff = cfg.kafkaRetryBackoff
+	config.Producer.Partitioner = cfg.kafkaPartitioner.constructor()
+	if cfg.kafkaIdempotent {
+		// The idempotent producer deduplicates retried messages, which requires acks from all in-sync replicas and
+		// at most one request in flight per broker.
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+	security.Apply(config)
+	return config
+}
@@ -2,243 +2,412 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	kafka "github.com/Shopify/sarama"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	"k8s.io/api/admission/v1beta1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"github.com/stackrox/admission-controller-heimdall/internal/jsonpointer"
+	"github.com/stackrox/admission-controller-heimdall/internal/metrics"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	tlsDir           = `/run/secrets/tls`
-	tlsCertFile      = `tls.crt`
-	tlsKeyFile       = `tls.key`
-	ownerLabel       = `app.heimdall.io/owner`
-	priorityLabel    = `app.heimdall.io/priority`
-	namespace        = "heimdall"
-	kafkaClusterName = "heimdall-kafka-cluster"
-	heimdallTopic    = "heimdall-topic"
+	tlsDir          = `/run/secrets/tls`
+	tlsCertFile     = `tls.crt`
+	tlsKeyFile      = `tls.key`
+	ownerLabel      = `app.heimdall.io/owner`
+	priorityLabel   = `app.heimdall.io/priority`
+	shutdownTimeout = 10 * time.Second
 )
 
-type ResourceDetails struct {
-	MessageID uuid.UUID
-	Name      string
-	Namespace string
-	Kind      string
-	Group     string
-	Version   string
+// garbageCollectorUsernames are the identities the garbage collector deletes dependents as, depending on whether the
+// controller manager runs with --use-service-account-credentials.
+var garbageCollectorUsernames = map[string]bool{
+	"system:serviceaccount:kube-system:generic-garbage-collector": true,
+	"system:kube-controller-manager":                              true,
 }
 
-func processResourceChanges(req *v1beta1.AdmissionRequest, senderIP string) ([]patchOperation, error) {
-	resourceDetails := ResourceDetails{
-		MessageID: uuid.New(),
-		Name:      req.Name,
-		Namespace: req.Namespace,
-		Kind:      req.Kind.Kind,
-		Group:     req.Kind.Group,
-		Version:   req.Kind.Version,
+// heimdall implements the admission logic protecting owned resources.
+type heimdall struct {
+	config    *config
+	clientset kubernetes.Interface
+	policies  *policyStore
+	sink      Sink
+	snapshots *snapshotRecorder
+}
+
+// newReconcileEvent creates the reconcile event for a request by a non-owner of the given resource. newObj is nil for
+// deletions. The reason is filled in by handleViolation.
+func newReconcileEvent(req *admissionRequest, existingObj, newObj *unstructured.Unstructured, resourceOwner owner) *reconcile.Event {
+	event := &reconcile.Event{
+		MessageID:       uuid.New(),
+		Name:            req.Name,
+		Namespace:       req.Namespace,
+		Kind:            req.Kind.Kind,
+		Group:           req.Kind.Group,
+		Version:         req.Kind.Version,
+		Operation:       string(req.Operation),
+		SchemaVersion:   reconcile.SchemaVersion,
+		UID:             existingObj.GetUID(),
+		ResourceVersion: existingObj.GetResourceVersion(),
+		User: reconcile.User{
+			Username: req.UserInfo.Username,
+			UID:      req.UserInfo.UID,
+			Groups:   req.UserInfo.Groups,
+		},
+		Owner:      resourceOwner.String(),
+		Priority:   existingObj.GetLabels()[priorityLabel],
+		Timestamp:  time.Now().UTC(),
+		RequestUID: req.UID,
+	}
+	if newObj != nil {
+		for _, path := range jsonpointer.Diff(existingObj.Object, newObj.Object, "", nil) {
+			if isServerManaged(path) {
+				continue
+			}
+			tokens, _ := jsonpointer.Parse(path)
+			change := reconcile.Change{Path: path}
+			change.Old, _ = jsonpointer.Lookup(existingObj.Object, tokens)
+			change.New, _ = jsonpointer.Lookup(newObj.Object, tokens)
+			event.Diff = append(event.Diff, change)
+		}
 	}
+	return event
+}
 
-	// Marshal the struct into a JSON string
-	resourceDetailsJSON, err := json.Marshal(resourceDetails)
+func (h *heimdall) processResourceChanges(ctx context.Context, req *admissionRequest) ([]patchOperation, []string, error) {
+	existingObj, newObj, err := decodeObjects(req)
 	if err != nil {
-		logrus.Errorf("ERROR: admission controller failed JSONifying Resource details: %v", err)
-		return nil, fmt.Errorf("ERROR: admision controller failed JSONifying Resource details: %v", err)
+		logrus.Errorf("ERROR: admission controller %v", err)
+		return nil, nil, fmt.Errorf("ERROR: admission controller %v", err)
+	}
+
+	switch req.Operation {
+	case admissionv1.Create:
+		return h.processCreate(req, newObj)
+	case admissionv1.Update:
+		return h.processUpdate(ctx, req, existingObj, newObj)
+	case admissionv1.Delete:
+		return h.processDelete(ctx, req, existingObj)
+	case admissionv1.Connect:
+		return h.processConnect(req)
 	}
 
-	existingObj := &unstructured.Unstructured{}
-	newObj := &unstructured.Unstructured{}
-	if err := json.Unmarshal(req.OldObject.Raw, existingObj); err != nil {
-		logrus.Errorf("ERROR: admission controller failed decoding existing object: %v", err)
-		return nil, fmt.Errorf("ERROR: admision controller failed decoding existing object: %v", err)
+	logrus.Errorf("ERROR: unsupported operation %q on %s/%s", req.Operation, req.Namespace, req.Name)
+	return nil, nil, fmt.Errorf("ERROR: unsupported operation %q", req.Operation)
+}
+
+// processCreate handles CREATE requests. A resource that does not exist yet has no owner whose state could be
+// violated, so creations are always allowed. Resources created in auto-owner namespaces or by auto-owner principals
+// are patched to be owned by their creator. The state of resources created by their owner, including stamped ones, is
+// recorded as approved by the owner.
+func (h *heimdall) processCreate(req *admissionRequest, newObj *unstructured.Unstructured) ([]patchOperation, []string, error) {
+	if newObj == nil {
+		return nil, nil, nil
 	}
-	if err := json.Unmarshal(req.Object.Raw, newObj); err != nil {
-		logrus.Errorf("ERROR: admission controller failed decoding new object: %v", err)
-		return nil, fmt.Errorf("ERROR: admission controller failed decoding new object: %v", err)
+	if err := validatePriorityLabel(nil, newObj); err != nil {
+		logrus.Warnf("DENIED: creation of %s/%s: %v", req.Namespace, newObj.GetName(), err)
+		return nil, nil, fmt.Errorf("DENIED: %v", err)
+	}
+	if h.shouldStampOwner(req, newObj) {
+		logRequest(req)
+		patchOps, stampedObj := h.stampOwner(req, newObj)
+		h.recordCreatedSnapshot(req, stampedObj, ownerForUser(req.UserInfo))
+		return patchOps, nil, nil
+	}
+	if resourceOwner, managed, err := ownerOf(newObj); managed {
+		logRequest(req)
+		logrus.Infof("ALLOWED: creation of Heimdall resource %s/%s", req.Namespace, newObj.GetName())
+		if err == nil && resourceOwner.matches(req.UserInfo) {
+			h.recordCreatedSnapshot(req, newObj, resourceOwner)
+		}
+	}
+	return nil, nil, nil
+}
+
+// recordCreatedSnapshot records the state of a resource created by its owner. Resources named by the API server
+// (generateName) are only recorded with their first update, as their name is not known before they are persisted.
+func (h *heimdall) recordCreatedSnapshot(req *admissionRequest, obj *unstructured.Unstructured, resourceOwner owner) {
+	if req.Name == "" {
+		return
+	}
+	h.recordSnapshot(req, obj, resourceOwner)
+}
+
+// processUpdate handles UPDATE requests, denying changes to the protected contents of an owned resource made by
+// anyone but its owner.
+func (h *heimdall) processUpdate(ctx context.Context, req *admissionRequest, existingObj, newObj *unstructured.Unstructured) ([]patchOperation, []string, error) {
+	if existingObj == nil || newObj == nil {
+		logrus.Errorf("ERROR: update of %s/%s is missing the existing or new object", req.Namespace, req.Name)
+		return nil, nil, fmt.Errorf("ERROR: update request is missing the existing or new object")
 	}
 
+	if err := validatePriorityLabel(existingObj, newObj); err != nil {
+		logrus.Warnf("DENIED: update of %s/%s: %v", req.Namespace, req.Name, err)
+		return nil, nil, fmt.Errorf("DENIED: %v", err)
+	}
+
+	if existingObj.GetLabels()[ownerLabel] == "" && newObj.GetLabels()[ownerLabel] == "" {
+		// not a heimdall object
+		return nil, nil, nil
+	}
+
+	logRequest(req)
+
 	// Check if the objects are equal
 	if reflect.DeepEqual(existingObj.Object, newObj.Object) {
 		logrus.Infof("ALLOWED: no changes detected, allowing request")
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	if newObj.GetLabels()["app.heimdall.io/owner"] == "" {
-		return nil, nil
+	// An invalid owner reference would lock everyone, including the owner, out of the resource.
+	if _, _, err := ownerOf(newObj); err != nil {
+		logrus.Warnf("DENIED: invalid owner reference for %s/%s: %v", req.Namespace, req.Name, err)
+		return nil, nil, fmt.Errorf("DENIED: invalid owner reference: %v", err)
+	}
+
+	resourceOwner, managed, err := ownerOf(existingObj)
+	if err != nil {
+		logrus.Errorf("ERROR: resource %s/%s has an invalid owner reference: %v", req.Namespace, req.Name, err)
+		return nil, nil, fmt.Errorf("ERROR: resource has an invalid owner reference: %v", err)
+	}
+	if !managed {
+		// the resource is only now being labelled as owned, there is no previous owner to protect
+		return nil, nil, nil
 	}
 
 	logrus.Infof("request is valid, validating contents of %s/%s", req.Namespace, req.Name)
 
-	ownerIP := existingObj.GetLabels()[ownerLabel]
+	requester := describeUser(req.UserInfo)
 
-	// Check if owner and sender IPs match
-	if senderIP == ownerIP {
-		logrus.Infof("ALLOWED: owner IP %s matches sender IP %s", ownerIP, senderIP)
-		return nil, nil
+	// Check if the requesting user is the owner
+	if resourceOwner.matches(req.UserInfo) {
+		logrus.Infof("ALLOWED: requesting user %s matches owner %s", requester, resourceOwner)
+		h.recordSnapshot(req, newObj, resourceOwner)
+		return nil, nil, nil
 	}
 
-	// Check if the specs have been changed
-	if !reflect.DeepEqual(existingObj.Object["spec"], newObj.Object["spec"]) {
-		if err := queueResourceForReconcile(namespace, kafkaClusterName, resourceDetailsJSON); err != nil {
-			logrus.Warnf("ERROR: failed to queue resource for reconcile: %v", err)
-			return nil, fmt.Errorf("ERROR: failed to queue resource for reconcile: %v", err)
-		}
-		logrus.Warnf("DENIED: non-owner %s cannot change Spec, resource queued for Reconcile", senderIP)
-		return nil, fmt.Errorf("DENIED: non-owner %s cannot change Spec", senderIP)
-	}
-
-	// Check if any non-allowed labels have been changed
-	allowedLabels := map[string]bool{
-		ownerLabel:    true,
-		priorityLabel: true,
-	}
-	existingLabels := existingObj.GetLabels()
-	newLabels := newObj.GetLabels()
-	for k, v := range newLabels {
-		if _, ok := allowedLabels[k]; !ok && existingLabels[k] != v {
-			if err := queueResourceForReconcile(namespace, kafkaClusterName, resourceDetailsJSON); err != nil {
-				logrus.Warnf("ERROR: failed to queue resource for reconcile: %v", err)
-				return nil, fmt.Errorf("ERROR: failed to queue resource for reconcile: %v", err)
+	// Reconcilers restore the state the owner approved, which they must not change the ownership of.
+	if h.isReconciler(req.UserInfo) && !ownershipChanged(existingObj, newObj) {
+		logrus.Infof("ALLOWED: reconciler %s restoring resource owned by %s", requester, resourceOwner)
+		return nil, nil, nil
+	}
+
+	prot := h.policies.protectionFor(req.Kind, req.Namespace, existingObj)
+	var violations []string
+	// revertPaths are the values the revert mode puts back.
+	var revertPaths []string
+
+	// Only the owner can change or remove the ownership metadata, unless the requesting user accepts a transfer the
+	// owner has nominated them for.
+	var patchOps []patchOperation
+	if ownershipChanged(existingObj, newObj) {
+		if successor, accepted := acceptedTransfer(existingObj, newObj, req.UserInfo); accepted {
+			logrus.Infof("ownership of %s/%s transferred from %s to %s", req.Namespace, req.Name, resourceOwner, successor)
+			if _, nominated := newObj.GetAnnotations()[successorAnnotation]; nominated {
+				patchOps = append(patchOps, patchOperation{
+					Op:   "remove",
+					Path: "/metadata/annotations/" + jsonpointer.Escape(successorAnnotation),
+				})
 			}
-			logrus.Warnf("DENIED: non-owner %s cannot change non-Heimdall label (%s: %s), resource queued for Reconcile", senderIP, k, v)
-			return nil, fmt.Errorf("DENIED: non-owner changes are not permitted to non-Heimdall label (%s: %s)", k, v)
+		} else {
+			violations = append(violations, fmt.Sprintf("cannot change the ownership of a resource owned by %s", resourceOwner))
+			revertPaths = append(revertPaths, ownershipPaths...)
 		}
 	}
 
+	// Check if any protected fields have been changed
+	if changed := prot.violations(existingObj, newObj); len(changed) > 0 {
+		logrus.Infof("protected fields changed by %s: %s", requester, strings.Join(changed, ", "))
+		violations = append(violations, fmt.Sprintf("cannot change protected fields: %s", summarizePaths(changed)))
+		revertPaths = append(revertPaths, changed...)
+	}
+
+	if len(violations) > 0 {
+		event := newReconcileEvent(req, existingObj, newObj, resourceOwner)
+		revertOps := revertPatch(existingObj.Object, newObj.Object, revertPaths)
+		return h.handleViolation(ctx, req, prot, event, patchOps, revertOps, strings.Join(violations, "; "))
+	}
+
 	// Permit the request if all checks pass
-	logrus.Infof("ALLOWED: request from %s changed a Heimdall label", senderIP)
-	return nil, nil
+	logrus.Infof("ALLOWED: request from %s changed no fields protected by %s", requester, prot)
+	return patchOps, nil, nil
 }
 
-func createKafkaTopic(config kafka.Config, brokerList []string) error {
-	admin, err := kafka.NewClusterAdmin(brokerList, &config)
-	if err != nil {
-		return err
+// summarizePaths lists the given JSON pointers for a denial message, eliding all but the first few.
+func summarizePaths(paths []string) string {
+	const maxPaths = 5
+	if len(paths) <= maxPaths {
+		return strings.Join(paths, ", ")
 	}
-	defer func() { _ = admin.Close() }()
+	return fmt.Sprintf("%s and %d more", strings.Join(paths[:maxPaths], ", "), len(paths)-maxPaths)
+}
 
-	// Check if topic already exists
-	topicMetadata, err := admin.DescribeTopics([]string{heimdallTopic})
-	if err == nil && len(topicMetadata) == 1 {
-		// Topic already exists
-		return nil
+// processDelete handles DELETE requests, denying the deletion of an owned resource by anyone but its owner.
+func (h *heimdall) processDelete(ctx context.Context, req *admissionRequest, existingObj *unstructured.Unstructured) ([]patchOperation, []string, error) {
+	if existingObj == nil {
+		// API servers before 1.15 do not send the object being deleted, so ownership cannot be determined.
+		return nil, nil, nil
 	}
 
-	// Create topic
-	topicDetails := kafka.TopicDetail{
-		NumPartitions:     2,
-		ReplicationFactor: 1,
-	}
-	err = admin.CreateTopic(heimdallTopic, &topicDetails, false)
-	if err != nil {
-		return err
+	resourceOwner, managed, err := ownerOf(existingObj)
+	if !managed {
+		return nil, nil, nil
 	}
 
-	return nil
-}
+	logRequest(req)
 
-func queueResourceForReconcile(namespace string, kafkaClusterName string, resourceDetails []byte) error {
-	// Get Kafka broker list
-	brokerList, err := getBrokerList(namespace, kafkaClusterName)
 	if err != nil {
-		logrus.Errorf("failed to get broker list: %v", err)
-		return err
+		logrus.Errorf("ERROR: resource %s/%s has an invalid owner reference: %v", req.Namespace, req.Name, err)
+		return nil, nil, fmt.Errorf("ERROR: resource has an invalid owner reference: %v", err)
 	}
 
-	logrus.Infof("retrieved Kafka broker address %s", brokerList)
-
-	// Set up Kafka producer config
-	config := kafka.NewConfig()
-	config.Producer.Return.Successes = true
-	config.Producer.Return.Errors = true
-	config.Producer.RequiredAcks = kafka.NoResponse
+	requester := describeUser(req.UserInfo)
 
-	// Connect to Kafka broker
-	producer, err := kafka.NewSyncProducer(brokerList, config)
-	if err != nil {
-		logrus.Errorf("failed to create Kafka producer: %v", err)
-		return err
+	if resourceOwner.matches(req.UserInfo) {
+		logrus.Infof("ALLOWED: requesting user %s matches owner %s", requester, resourceOwner)
+		h.forgetSnapshot(req)
+		return nil, nil, nil
 	}
-	defer producer.Close()
 
-	err = createKafkaTopic(*config, brokerList)
-	if err != nil {
-		logrus.Errorf("failed to create Kafka topic: %v", err)
-		return err
+	// Dependents are deleted by the garbage collector once their parents are gone, which it verifies itself before
+	// deleting them. Who deleted the parents is not checked: only parents with an owner of their own are protected, so
+	// deleting an unowned parent also deletes its owned dependents.
+	if h.config.allowGarbageCollectorDeletes && garbageCollectorUsernames[req.UserInfo.Username] &&
+		len(existingObj.GetOwnerReferences()) > 0 {
+		logrus.Infof("ALLOWED: garbage collector %s deleting dependent resource", requester)
+		h.forgetSnapshot(req)
+		return nil, nil, nil
 	}
 
-	// Publish a message to Kafka
-	message := &kafka.ProducerMessage{
-		Topic: heimdallTopic,
-		Value: kafka.StringEncoder(resourceDetails),
-	}
+	prot := h.policies.protectionFor(req.Kind, req.Namespace, existingObj)
+	event := newReconcileEvent(req, existingObj, nil, resourceOwner)
+	return h.handleViolation(ctx, req, prot, event, nil, nil, fmt.Sprintf("cannot delete resource owned by %s", resourceOwner))
+}
 
-	partition, offset, err := producer.SendMessage(message)
-	if err != nil {
-		logrus.Errorf("failed to send message to Kafka: %v", err)
-		return err
-	}
+// processConnect handles CONNECT requests (exec, attach, port-forward, proxy). These do not modify the resource and
+// are always allowed.
+func (h *heimdall) processConnect(req *admissionRequest) ([]patchOperation, []string, error) {
+	return nil, nil, nil
+}
 
-	logrus.Infof("sent message to Kafka. Partition: %d, Offset: %d", partition, offset)
+// logRequest logs the start of the processing of a request for a Heimdall resource.
+func logRequest(req *admissionRequest) {
+	logrus.Infof("────────────────────────────────────────────────────────────")
+	logrus.Infof("processing %s request for resource %s/%s", req.Operation, req.Namespace, req.Name)
+	logrus.Infof("request sender: %s (uid %q, groups %v)", describeUser(req.UserInfo), req.UserInfo.UID, req.UserInfo.Groups)
+}
 
+// publishReconcile queues the resource of the given event for reconciliation.
+func (h *heimdall) publishReconcile(ctx context.Context, event *reconcile.Event) error {
+	if err := h.sink.Publish(ctx, event); err != nil {
+		logrus.Warnf("ERROR: failed to queue resource for reconcile: %v", err)
+		return fmt.Errorf("ERROR: failed to queue resource for reconcile: %v", err)
+	}
 	return nil
 }
 
-func getBrokerList(namespace string, kafkaClusterName string) ([]string, error) {
-	// Create Kubernetes clientset
-	config, err := rest.InClusterConfig()
+func main() {
+	certPath := filepath.Join(tlsDir, tlsCertFile)
+	keyPath := filepath.Join(tlsDir, tlsKeyFile)
+
+	cfg, err := loadConfig()
 	if err != nil {
-		return nil, err
+		logrus.Fatalf("invalid configuration: %v", err)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	restConfig, err := rest.InClusterConfig()
 	if err != nil {
-		return nil, err
+		logrus.Fatalf("failed to load in-cluster Kubernetes config: %v", err)
 	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		logrus.Fatalf("failed to create Kubernetes client: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		logrus.Fatalf("failed to create Kubernetes client: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
 
-	// Get list of Kafka broker services
-	svcList, err := clientset.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("strimzi.io/cluster=%s,strimzi.io/kind=Kafka", kafkaClusterName),
-	})
+	policies, err := newPolicyStore(dynamicClient, cfg.defaultEnforcement, stopCh)
 	if err != nil {
-		return nil, err
+		logrus.Fatalf("failed to watch HeimdallPolicies: %v", err)
 	}
 
-	// Create list of broker addresses in format "broker-address:broker-port"
-	brokerList := make([]string, len(svcList.Items))
-	for i, svc := range svcList.Items {
-		if svc.Spec.ClusterIP != "None" && strings.Contains(svc.Name, "bootstrap") {
-			brokerAddress := fmt.Sprintf("%s:%d", svc.Spec.ClusterIP, 9092)
-			brokerAddress = strings.Replace(brokerAddress, " ", "", -1)
-			brokerList[i] = brokerAddress
+	sink, err := newSink(cfg, clientset, dynamicClient, stopCh)
+	if err != nil {
+		logrus.Fatalf("failed to create reconcile sinks: %v", err)
+	}
+	if cfg.coalesce {
+		sink = newCoalescingSink(sink, cfg.coalesceWindows, cfg.defaultPriority)
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			logrus.Errorf("failed to close reconcile sinks: %v", err)
 		}
+	}()
 
+	store, err := newSnapshotStore(cfg, clientset)
+	if err != nil {
+		logrus.Fatalf("failed to create the snapshot store: %v", err)
+	}
+	var snapshots *snapshotRecorder
+	if store != nil {
+		snapshots = newSnapshotRecorder(store, cfg.snapshotMaxEntries, cfg.snapshotPruneInterval)
+		defer snapshots.Close()
 	}
 
-	return brokerList, nil
-}
+	h := &heimdall{config: cfg, clientset: clientset, policies: policies, sink: sink, snapshots: snapshots}
 
-func main() {
-	certPath := filepath.Join(tlsDir, tlsCertFile)
-	keyPath := filepath.Join(tlsDir, tlsKeyFile)
+	metricsServer := metrics.NewServer(cfg.metricsAddr)
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("metrics server failed: %v", err)
+		}
+	}()
+	defer metricsServer.Close()
 
 	mux := http.NewServeMux()
-	mux.Handle("/mutate", admitFuncHandler(processResourceChanges))
+	mux.Handle("/mutate", admitFuncHandler(h.processResourceChanges))
 	server := &http.Server{
 		// We listen on port 8443 such that we do not need root privileges or extra capabilities for this server.
 		// The Service object will take care of mapping this port to the HTTPS port 443.
 		Addr:    ":8443",
 		Handler: mux,
 	}
-	log.Fatal(server.ListenAndServeTLS(certPath, keyPath))
+
+	serverErrCh := make(chan error, 1)
+	go func() {
+		serverErrCh <- server.ListenAndServeTLS(certPath, keyPath)
+	}()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serverErrCh:
+		logrus.Errorf("webhook server failed: %v", err)
+	case sig := <-signalCh:
+		logrus.Infof("received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.Errorf("failed to shut down webhook server: %v", err)
+		}
+	}
 }
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testReconciler       = "system:serviceaccount:heimdall:reconciler"
+	testGarbageCollector = "system:serviceaccount:kube-system:generic-garbage-collector"
+)
+
+// handlerResult is the outcome of a request handler: the error message is empty if the request is allowed.
+type handlerResult struct {
+	patchOps []patchOperation
+	warnings []string
+	err      string
+}
+
+func TestProcessCreate(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		obj  *unstructured.Unstructured
+
+		wantPatch     []patchOperation
+		wantErrPrefix string
+	}{
+		{
+			name: "unowned",
+			user: "bob",
+			obj:  testDeployment("", "nginx:1.24"),
+		},
+		{
+			name: "owned by someone else",
+			user: "bob",
+			obj:  testDeployment("jane", "nginx:1.24"),
+		},
+		{
+			name: "auto-owner namespace",
+			user: "bob",
+			obj:  withNamespace(testDeployment("", "nginx:1.24"), "auto"),
+			wantPatch: []patchOperation{
+				{Op: "add", Path: "/metadata/labels", Value: map[string]string{ownerLabel: "bob"}},
+			},
+		},
+		{
+			name:          "invalid priority",
+			user:          "jane",
+			obj:           withLabel(testDeployment("jane", "nginx:1.24"), priorityLabel, "urgent"),
+			wantErrPrefix: "DENIED:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, sink := newTestHeimdall(t, enforcementEnforce)
+			req := newTestRequest(admissionv1.Create, tt.user, tt.obj)
+			got := handlerOutcome(h.processCreate(req, tt.obj))
+
+			checkHandlerOutcome(t, got, tt.wantPatch, false, tt.wantErrPrefix)
+			checkReconcileRequest(t, sink, req, "")
+		})
+	}
+}
+
+func TestProcessUpdate(t *testing.T) {
+	const wantReason = "non-owner bob cannot change protected fields: /spec/template/spec/containers/0/image"
+	revertImage := []patchOperation{{Op: "replace", Path: "/spec/template/spec/containers/0/image", Value: "nginx:1.24"}}
+	tests := []struct {
+		name      string
+		mode      enforcementMode
+		user      string
+		dryRun    bool
+		sinkFails bool
+		existing  *unstructured.Unstructured
+		new       *unstructured.Unstructured
+
+		wantPatch     []patchOperation
+		wantWarning   bool
+		wantErrPrefix string
+		// wantReason is the reason of the published reconcile request, empty if none is published.
+		wantReason string
+	}{
+		{
+			name:     "owner",
+			mode:     enforcementEnforce,
+			user:     "jane",
+			existing: testDeployment("jane", "nginx:1.24"),
+			new:      testDeployment("jane", "nginx:1.25"),
+		},
+		{
+			name:     "not a Heimdall resource",
+			mode:     enforcementEnforce,
+			user:     "bob",
+			existing: testDeployment("", "nginx:1.24"),
+			new:      testDeployment("", "nginx:1.25"),
+		},
+		{
+			name:     "ignored path",
+			mode:     enforcementEnforce,
+			user:     "bob",
+			existing: testDeployment("jane", "nginx:1.24"),
+			new:      withReplicas(testDeployment("jane", "nginx:1.24"), 5),
+		},
+		{
+			name:     "reconciler",
+			mode:     enforcementEnforce,
+			user:     testReconciler,
+			existing: testDeployment("jane", "nginx:1.24"),
+			new:      testDeployment("jane", "nginx:1.25"),
+		},
+		{
+			name:          "enforce",
+			mode:          enforcementEnforce,
+			user:          "bob",
+			existing:      testDeployment("jane", "nginx:1.24"),
+			new:           testDeployment("jane", "nginx:1.25"),
+			wantErrPrefix: "DENIED: " + wantReason,
+			wantReason:    wantReason,
+		},
+		{
+			name:        "warn",
+			mode:        enforcementWarn,
+			user:        "bob",
+			existing:    testDeployment("jane", "nginx:1.24"),
+			new:         testDeployment("jane", "nginx:1.25"),
+			wantWarning: true,
+			wantReason:  wantReason,
+		},
+		{
+			name:       "audit",
+			mode:       enforcementAudit,
+			user:       "bob",
+			existing:   testDeployment("jane", "nginx:1.24"),
+			new:        testDeployment("jane", "nginx:1.25"),
+			wantReason: wantReason,
+		},
+		{
+			name:        "revert",
+			mode:        enforcementRevert,
+			user:        "bob",
+			existing:    testDeployment("jane", "nginx:1.24"),
+			new:         withReplicas(testDeployment("jane", "nginx:1.25"), 5),
+			wantPatch:   revertImage,
+			wantWarning: true,
+			wantReason:  wantReason,
+		},
+		{
+			name:          "ownership change",
+			mode:          enforcementEnforce,
+			user:          "bob",
+			existing:      testDeployment("jane", "nginx:1.24"),
+			new:           testDeployment("bob", "nginx:1.24"),
+			wantErrPrefix: "DENIED: non-owner bob cannot change the ownership of a resource owned by jane",
+			wantReason:    "non-owner bob cannot change the ownership of a resource owned by jane",
+		},
+		{
+			name:          "dry run",
+			mode:          enforcementEnforce,
+			user:          "bob",
+			dryRun:        true,
+			existing:      testDeployment("jane", "nginx:1.24"),
+			new:           testDeployment("jane", "nginx:1.25"),
+			wantErrPrefix: "DENIED: " + wantReason,
+		},
+		{
+			name:          "sink unavailable in enforce mode",
+			mode:          enforcementEnforce,
+			user:          "bob",
+			sinkFails:     true,
+			existing:      testDeployment("jane", "nginx:1.24"),
+			new:           testDeployment("jane", "nginx:1.25"),
+			wantErrPrefix: "ERROR: failed to queue resource for reconcile",
+		},
+		{
+			name:        "sink unavailable in warn mode",
+			mode:        enforcementWarn,
+			user:        "bob",
+			sinkFails:   true,
+			existing:    testDeployment("jane", "nginx:1.24"),
+			new:         testDeployment("jane", "nginx:1.25"),
+			wantWarning: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, sink := newTestHeimdall(t, tt.mode)
+			req := newTestRequest(admissionv1.Update, tt.user, tt.new)
+			req.DryRun = tt.dryRun
+			if tt.sinkFails {
+				sink.failing[req.UID] = true
+			}
+			got := handlerOutcome(h.processUpdate(context.Background(), req, tt.existing, tt.new))
+
+			checkHandlerOutcome(t, got, tt.wantPatch, tt.wantWarning, tt.wantErrPrefix)
+			checkReconcileRequest(t, sink, req, tt.wantReason)
+		})
+	}
+}
+
+func TestProcessDelete(t *testing.T) {
+	const wantReason = "non-owner bob cannot delete resource owned by jane"
+	tests := []struct {
+		name     string
+		mode     enforcementMode
+		user     string
+		existing *unstructured.Unstructured
+
+		wantWarning   bool
+		wantErrPrefix string
+		wantReason    string
+	}{
+		{
+			name:     "owner",
+			mode:     enforcementEnforce,
+			user:     "jane",
+			existing: testDeployment("jane", "nginx:1.24"),
+		},
+		{
+			name:     "not a Heimdall resource",
+			mode:     enforcementEnforce,
+			user:     "bob",
+			existing: testDeployment("", "nginx:1.24"),
+		},
+		{
+			name:     "garbage collector deleting a dependent",
+			mode:     enforcementEnforce,
+			user:     testGarbageCollector,
+			existing: withOwnerReference(testDeployment("jane", "nginx:1.24")),
+		},
+		{
+			name:          "garbage collector deleting a parent",
+			mode:          enforcementEnforce,
+			user:          testGarbageCollector,
+			existing:      testDeployment("jane", "nginx:1.24"),
+			wantErrPrefix: "DENIED: non-owner " + testGarbageCollector,
+			wantReason:    "non-owner " + testGarbageCollector + " cannot delete resource owned by jane",
+		},
+		{
+			name:          "enforce",
+			mode:          enforcementEnforce,
+			user:          "bob",
+			existing:      testDeployment("jane", "nginx:1.24"),
+			wantErrPrefix: "DENIED: " + wantReason,
+			wantReason:    wantReason,
+		},
+		{
+			name:        "warn",
+			mode:        enforcementWarn,
+			user:        "bob",
+			existing:    testDeployment("jane", "nginx:1.24"),
+			wantWarning: true,
+			wantReason:  wantReason,
+		},
+		{
+			name:       "audit",
+			mode:       enforcementAudit,
+			user:       "bob",
+			existing:   testDeployment("jane", "nginx:1.24"),
+			wantReason: wantReason,
+		},
+		{
+			// Deletions cannot be reverted.
+			name:          "revert",
+			mode:          enforcementRevert,
+			user:          "bob",
+			existing:      testDeployment("jane", "nginx:1.24"),
+			wantErrPrefix: "DENIED: " + wantReason,
+			wantReason:    wantReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, sink := newTestHeimdall(t, tt.mode)
+			req := newTestRequest(admissionv1.Delete, tt.user, tt.existing)
+			got := handlerOutcome(h.processDelete(context.Background(), req, tt.existing))
+
+			checkHandlerOutcome(t, got, nil, tt.wantWarning, tt.wantErrPrefix)
+			checkReconcileRequest(t, sink, req, tt.wantReason)
+		})
+	}
+}
+
+// newTestHeimdall returns a handler without Kubernetes clients or snapshots, whose policy protects the spec of
+// deployments except for the replicas with the given enforcement mode, publishing to the returned sink.
+func newTestHeimdall(t *testing.T, mode enforcementMode) (*heimdall, *recordingSink) {
+	policies := newTestPolicyStore(t, mode, nil, newTestPolicy("deployments", HeimdallPolicySpec{
+		Match:          PolicyMatch{Resources: []PolicyResource{{Group: "apps", Kind: "Deployment"}}},
+		ProtectedPaths: []string{"/spec"},
+		IgnoredPaths:   []string{"/spec/replicas"},
+		Enforcement:    string(mode),
+	}))
+	sink := &recordingSink{failing: make(map[types.UID]bool)}
+	reconciler, err := parseOwner(testReconciler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &heimdall{
+		config: &config{
+			allowGarbageCollectorDeletes: true,
+			autoOwnerNamespaces:          map[string]bool{"auto": true},
+			reconcilerPrincipals:         []owner{reconciler},
+		},
+		policies: policies,
+		sink:     sink,
+	}
+	return h, sink
+}
+
+func newTestRequest(operation admissionv1.Operation, username string, obj *unstructured.Unstructured) *admissionRequest {
+	return &admissionRequest{
+		UID:       types.UID("request-" + strings.ToLower(string(operation))),
+		Kind:      deploymentGVK,
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+		Operation: operation,
+		UserInfo:  authenticationv1.UserInfo{Username: username},
+	}
+}
+
+// testDeployment returns a deployment in the team-a namespace owned by the given user, unowned if it is empty.
+func testDeployment(ownerRef, image string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "team-a"},
+		"spec": map[string]interface{}{
+			"replicas": int64(3),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{"name": "web", "image": image}},
+				},
+			},
+		},
+	}}
+	if ownerRef != "" {
+		obj.SetLabels(map[string]string{ownerLabel: ownerRef})
+	}
+	return obj
+}
+
+func withNamespace(obj *unstructured.Unstructured, namespace string) *unstructured.Unstructured {
+	obj.SetNamespace(namespace)
+	return obj
+}
+
+func withLabel(obj *unstructured.Unstructured, key, value string) *unstructured.Unstructured {
+	objLabels := obj.GetLabels()
+	if objLabels == nil {
+		objLabels = make(map[string]string)
+	}
+	objLabels[key] = value
+	obj.SetLabels(objLabels)
+	return obj
+}
+
+func withReplicas(obj *unstructured.Unstructured, replicas int64) *unstructured.Unstructured {
+	if err := unstructured.SetNestedField(obj.Object, replicas, "spec", "replicas"); err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+func withOwnerReference(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "v1", Kind: "Namespace", Name: "team-a", UID: "1"}})
+	return obj
+}
+
+func handlerOutcome(patchOps []patchOperation, warnings []string, err error) handlerResult {
+	result := handlerResult{patchOps: patchOps, warnings: warnings}
+	if err != nil {
+		result.err = err.Error()
+	}
+	return result
+}
+
+// checkHandlerOutcome checks the outcome of a request handler. An empty wantErrPrefix expects the request to be
+// allowed.
+func checkHandlerOutcome(t *testing.T, got handlerResult, wantPatch []patchOperation, wantWarning bool, wantErrPrefix string) {
+	t.Helper()
+	if wantErrPrefix == "" {
+		if got.err != "" {
+			t.Errorf("denied with %q, want the request allowed", got.err)
+		}
+	} else if !strings.HasPrefix(got.err, wantErrPrefix) {
+		t.Errorf("error = %q, want prefix %q", got.err, wantErrPrefix)
+	}
+	if !reflect.DeepEqual(got.patchOps, wantPatch) {
+		t.Errorf("patch = %+v, want %+v", got.patchOps, wantPatch)
+	}
+	if (len(got.warnings) > 0) != wantWarning {
+		t.Errorf("warnings = %q, want warning %t", got.warnings, wantWarning)
+	}
+}
+
+// checkReconcileRequest checks that the sink received a single reconcile request for the resource of req, whose reason
+// starts with wantReason, or none if wantReason is empty.
+func checkReconcileRequest(t *testing.T, sink *recordingSink, req *admissionRequest, wantReason string) {
+	t.Helper()
+	events := sink.published()
+	if wantReason == "" {
+		if len(events) != 0 {
+			t.Errorf("published %d reconcile requests, want none", len(events))
+		}
+		return
+	}
+	if len(events) != 1 {
+		t.Fatalf("published %d reconcile requests, want 1", len(events))
+	}
+	want := &reconcile.Event{
+		Name:       req.Name,
+		Namespace:  req.Namespace,
+		Kind:       "Deployment",
+		Group:      "apps",
+		Version:    "v1",
+		Operation:  string(req.Operation),
+		RequestUID: req.UID,
+		User:       reconcile.User{Username: req.UserInfo.Username},
+		Owner:      "jane",
+	}
+	got := events[0]
+	if !strings.HasPrefix(got.Reason, wantReason) {
+		t.Errorf("reason = %q, want prefix %q", got.Reason, wantReason)
+	}
+	if got.Name != want.Name || got.Namespace != want.Namespace || got.Kind != want.Kind || got.Group != want.Group ||
+		got.Version != want.Version || got.Operation != want.Operation || got.RequestUID != want.RequestUID ||
+		!reflect.DeepEqual(got.User, want.User) || got.Owner != want.Owner {
+		t.Errorf("reconcile request = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "expvar"
+
+// Metrics are published with expvar and served as JSON on the metrics address, see metrics.NewServer.
+var (
+	metricQueueEnqueued = expvar.NewInt("heimdall_reconcile_queue_enqueued_total")
+	metricQueueDropped  = expvar.NewInt("heimdall_reconcile_queue_dropped_total")
+	metricQueueRejected = expvar.NewInt("heimdall_reconcile_queue_rejected_total")
+	metricKafkaSent     = expvar.NewInt("heimdall_kafka_messages_sent_total")
+	metricKafkaFailed   = expvar.NewInt("heimdall_kafka_messages_failed_total")
+	metricSpoolAppended = expvar.NewInt("heimdall_spool_appended_total")
+	metricSpoolReplayed = expvar.NewInt("heimdall_spool_replayed_total")
+	metricSpoolDropped  = expvar.NewInt("heimdall_spool_dropped_total")
+
+	metricCoalesceSuppressed = expvar.NewInt("heimdall_reconcile_coalesced_total")
+	metricCoalesceRetries    = expvar.NewInt("heimdall_reconcile_retries_dropped_total")
+
+	metricSnapshotsRecorded  = expvar.NewInt("heimdall_snapshots_recorded_total")
+	metricSnapshotsUnchanged = expvar.NewInt("heimdall_snapshots_unchanged_total")
+	metricSnapshotsDropped   = expvar.NewInt("heimdall_snapshots_dropped_total")
+	metricSnapshotsFailed    = expvar.NewInt("heimdall_snapshots_failed_total")
+	metricSnapshotsPruned    = expvar.NewInt("heimdall_snapshots_pruned_total")
+)
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/jsonpointer"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"strings"
+)
+
+const (
+	// ownerAnnotation optionally carries the full owner reference for owners whose identity cannot be expressed as a
+	// label value (e.g. usernames containing `:` or `@`). When set, it takes precedence over the owner label.
+	ownerAnnotation = `app.heimdall.io/owner`
+	// successorAnnotation is set by the current owner to nominate the successor in an ownership transfer. The transfer
+	// completes when the successor sets the owner label (or annotation) to themselves.
+	successorAnnotation = `app.heimdall.io/owner-successor`
+
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+)
+
+type ownerKind string
+
+const (
+	ownerKindUser           ownerKind = "user"
+	ownerKindServiceAccount ownerKind = "sa"
+	ownerKindGroup          ownerKind = "group"
+	ownerKindUID            ownerKind = "uid"
+)
+
+// owner identifies the Kubernetes principal that owns a Heimdall-managed resource.
+//
+// An owner reference is written as one of:
+//
+//	<username>                                    a user, e.g. jane or jane@example.com
+//	user:<username>         user.<username>       a user, explicitly
+//	system:serviceaccount:<namespace>:<name>      a service account
+//	sa:<namespace>:<name>   sa.<namespace>.<name> a service account
+//	group:<name>            group.<name>          any member of a group
+//	uid:<uid>               uid.<uid>             a user with the given UID
+//
+// The dotted forms are valid label values and are meant for the owner label; the others can be used in the owner
+// annotation.
+type owner struct {
+	kind      ownerKind
+	namespace string
+	name      string
+}
+
+// parseOwner parses an owner reference as found in the owner label or annotation.
+func parseOwner(ref string) (owner, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return owner{}, fmt.Errorf("empty owner reference")
+	}
+
+	if strings.HasPrefix(ref, serviceAccountUsernamePrefix) {
+		return parseServiceAccountOwner(strings.TrimPrefix(ref, serviceAccountUsernamePrefix), ":")
+	}
+
+	for _, sep := range []string{":", "."} {
+		prefix, rest, found := strings.Cut(ref, sep)
+		if !found {
+			continue
+		}
+		switch ownerKind(prefix) {
+		case ownerKindServiceAccount:
+			return parseServiceAccountOwner(rest, sep)
+		case ownerKindUser, ownerKindGroup, ownerKindUID:
+			if rest == "" {
+				return owner{}, fmt.Errorf("invalid owner reference %q: missing %s name", ref, prefix)
+			}
+			return owner{kind: ownerKind(prefix), name: rest}, nil
+		}
+	}
+
+	return owner{kind: ownerKindUser, name: ref}, nil
+}
+
+func parseServiceAccountOwner(ref, sep string) (owner, error) {
+	// Namespaces are DNS labels and cannot contain the separator, so everything after the first one is the name.
+	ns, name, found := strings.Cut(ref, sep)
+	if !found || ns == "" || name == "" {
+		return owner{}, fmt.Errorf("invalid service account owner reference %q, expected <namespace>%s<name>", ref, sep)
+	}
+	return owner{kind: ownerKindServiceAccount, namespace: ns, name: name}, nil
+}
+
+// ownerOf returns the owner of a Heimdall-managed object. The second return value is false if the object does not
+// carry the owner label, i.e., is not managed by Heimdall.
+func ownerOf(obj *unstructured.Unstructured) (owner, bool, error) {
+	if obj == nil {
+		return owner{}, false, nil
+	}
+	label := obj.GetLabels()[ownerLabel]
+	if label == "" {
+		return owner{}, false, nil
+	}
+	ref := label
+	if annotation := obj.GetAnnotations()[ownerAnnotation]; annotation != "" {
+		ref = annotation
+	}
+	o, err := parseOwner(ref)
+	if err != nil {
+		return owner{}, true, err
+	}
+	return o, true, nil
+}
+
+// ownerForUser returns the owner reference designating the given requesting user.
+func ownerForUser(user authenticationv1.UserInfo) owner {
+	if strings.HasPrefix(user.Username, serviceAccountUsernamePrefix) {
+		if o, err := parseOwner(user.Username); err == nil {
+			return o
+		}
+	}
+	return owner{kind: ownerKindUser, name: user.Username}
+}
+
+// labelValue returns the owner reference in its dotted form, suitable for the owner label. The second return value is
+// false if the owner cannot be represented as a label value, in which case the owner annotation has to be used.
+func (o owner) labelValue() (string, bool) {
+	var v string
+	switch o.kind {
+	case ownerKindUser:
+		v = o.name
+	case ownerKindServiceAccount:
+		v = string(o.kind) + "." + o.namespace + "." + o.name
+	default:
+		v = string(o.kind) + "." + o.name
+	}
+	if len(validation.IsValidLabelValue(v)) > 0 {
+		return "", false
+	}
+	return v, true
+}
+
+// ownershipPaths are the JSON pointers of the ownership metadata, see ownershipChanged.
+var ownershipPaths = []string{
+	"/metadata/labels/" + jsonpointer.Escape(ownerLabel),
+	"/metadata/annotations/" + jsonpointer.Escape(ownerAnnotation),
+	"/metadata/annotations/" + jsonpointer.Escape(successorAnnotation),
+}
+
+// ownershipChanged checks if the ownership metadata (owner label, owner annotation or successor nomination) differs
+// between the existing and the new version of an object.
+func ownershipChanged(existingObj, newObj *unstructured.Unstructured) bool {
+	return existingObj.GetLabels()[ownerLabel] != newObj.GetLabels()[ownerLabel] ||
+		existingObj.GetAnnotations()[ownerAnnotation] != newObj.GetAnnotations()[ownerAnnotation] ||
+		existingObj.GetAnnotations()[successorAnnotation] != newObj.GetAnnotations()[successorAnnotation]
+}
+
+// isReconciler checks if the requesting user is one of the configured reconciler principals.
+func (h *heimdall) isReconciler(user authenticationv1.UserInfo) bool {
+	for _, principal := range h.config.reconcilerPrincipals {
+		if principal.matches(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedTransfer checks if the ownership change from the existing to the new object is the acceptance of a transfer
+// nominated by the current owner: the requesting user must be the nominated successor and make themselves the owner,
+// leaving the nomination unchanged or removing it.
+func acceptedTransfer(existingObj, newObj *unstructured.Unstructured, user authenticationv1.UserInfo) (owner, bool) {
+	nomination := existingObj.GetAnnotations()[successorAnnotation]
+	if nomination == "" {
+		return owner{}, false
+	}
+	successor, err := parseOwner(nomination)
+	if err != nil || !successor.matches(user) {
+		return owner{}, false
+	}
+	if n := newObj.GetAnnotations()[successorAnnotation]; n != "" && n != nomination {
+		return owner{}, false
+	}
+	newOwner, managed, err := ownerOf(newObj)
+	if err != nil || !managed || newOwner != successor {
+		return owner{}, false
+	}
+	return successor, true
+}
+
+// matches checks if the given requesting user is (or, for groups, belongs to) the owner.
+func (o owner) matches(user authenticationv1.UserInfo) bool {
+	switch o.kind {
+	case ownerKindUser:
+		return user.Username == o.name
+	case ownerKindServiceAccount:
+		return user.Username == serviceAccountUsernamePrefix+o.namespace+":"+o.name
+	case ownerKindGroup:
+		for _, g := range user.Groups {
+			if g == o.name {
+				return true
+			}
+		}
+		return false
+	case ownerKindUID:
+		return user.UID != "" && user.UID == o.name
+	}
+	return false
+}
+
+// String returns the canonical form of the owner reference.
+func (o owner) String() string {
+	switch o.kind {
+	case ownerKindServiceAccount:
+		return serviceAccountUsernamePrefix + o.namespace + ":" + o.name
+	case ownerKindUser:
+		return o.name
+	}
+	return string(o.kind) + ":" + o.name
+}
+
+// describeUser returns a human-readable description of the requesting user for log and denial messages.
+func describeUser(user authenticationv1.UserInfo) string {
+	if user.Username == "" {
+		return "<unknown user>"
+	}
+	return user.Username
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"testing"
+)
+
+func TestParseOwner(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    owner
+		wantErr bool
+	}{
+		{ref: "jane", want: owner{kind: ownerKindUser, name: "jane"}},
+		{ref: "jane@example.com", want: owner{kind: ownerKindUser, name: "jane@example.com"}},
+		{ref: "  jane  ", want: owner{kind: ownerKindUser, name: "jane"}},
+		{ref: "user:jane", want: owner{kind: ownerKindUser, name: "jane"}},
+		{ref: "user.jane", want: owner{kind: ownerKindUser, name: "jane"}},
+		{ref: "user:jane@example.com", want: owner{kind: ownerKindUser, name: "jane@example.com"}},
+		{ref: "system:serviceaccount:ns:deployer", want: owner{kind: ownerKindServiceAccount, namespace: "ns", name: "deployer"}},
+		{ref: "sa:ns:deployer", want: owner{kind: ownerKindServiceAccount, namespace: "ns", name: "deployer"}},
+		{ref: "sa.ns.deployer", want: owner{kind: ownerKindServiceAccount, namespace: "ns", name: "deployer"}},
+		{ref: "sa.ns.deployer.v2", want: owner{kind: ownerKindServiceAccount, namespace: "ns", name: "deployer.v2"}},
+		{ref: "group:devs", want: owner{kind: ownerKindGroup, name: "devs"}},
+		{ref: "group.devs", want: owner{kind: ownerKindGroup, name: "devs"}},
+		{ref: "group:system:masters", want: owner{kind: ownerKindGroup, name: "system:masters"}},
+		{ref: "uid:6f1a4693-0c1d", want: owner{kind: ownerKindUID, name: "6f1a4693-0c1d"}},
+		{ref: "uid.6f1a4693-0c1d", want: owner{kind: ownerKindUID, name: "6f1a4693-0c1d"}},
+		// Unknown prefixes are part of the username.
+		{ref: "system:admin", want: owner{kind: ownerKindUser, name: "system:admin"}},
+		{ref: "jane.doe", want: owner{kind: ownerKindUser, name: "jane.doe"}},
+
+		{ref: "", wantErr: true},
+		{ref: "   ", wantErr: true},
+		{ref: "user:", wantErr: true},
+		{ref: "group.", wantErr: true},
+		{ref: "uid:", wantErr: true},
+		{ref: "sa:ns", wantErr: true},
+		{ref: "sa.ns.", wantErr: true},
+		{ref: "sa:", wantErr: true},
+		{ref: "sa::deployer", wantErr: true},
+		{ref: "system:serviceaccount:ns", wantErr: true},
+		{ref: "system:serviceaccount::deployer", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseOwner(tt.ref)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseOwner(%q) = %+v, want an error", tt.ref, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseOwner(%q) failed: %v", tt.ref, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseOwner(%q) = %+v, want %+v", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestOwnerLabelValueRoundTrip(t *testing.T) {
+	tests := []struct {
+		owner     owner
+		wantLabel string
+		wantOK    bool
+	}{
+		{owner: owner{kind: ownerKindUser, name: "jane"}, wantLabel: "jane", wantOK: true},
+		{owner: owner{kind: ownerKindServiceAccount, namespace: "ns", name: "deployer"}, wantLabel: "sa.ns.deployer", wantOK: true},
+		{owner: owner{kind: ownerKindGroup, name: "devs"}, wantLabel: "group.devs", wantOK: true},
+		{owner: owner{kind: ownerKindUID, name: "6f1a4693-0c1d"}, wantLabel: "uid.6f1a4693-0c1d", wantOK: true},
+		{owner: owner{kind: ownerKindUser, name: "jane@example.com"}},
+		{owner: owner{kind: ownerKindGroup, name: "system:masters"}},
+	}
+	for _, tt := range tests {
+		label, ok := tt.owner.labelValue()
+		if label != tt.wantLabel || ok != tt.wantOK {
+			t.Errorf("%+v.labelValue() = %q, %v, want %q, %v", tt.owner, label, ok, tt.wantLabel, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		parsed, err := parseOwner(label)
+		if err != nil || parsed != tt.owner {
+			t.Errorf("parseOwner(%q) = %+v, %v, want %+v", label, parsed, err, tt.owner)
+		}
+		if reparsed, err := parseOwner(tt.owner.String()); err != nil || reparsed != tt.owner {
+			t.Errorf("parseOwner(%q) = %+v, %v, want %+v", tt.owner.String(), reparsed, err, tt.owner)
+		}
+	}
+}
+
+func TestOwnerMatches(t *testing.T) {
+	jane := authenticationv1.UserInfo{Username: "jane", UID: "1234", Groups: []string{"devs", "system:authenticated"}}
+	deployer := authenticationv1.UserInfo{Username: "system:serviceaccount:ns:deployer"}
+	tests := []struct {
+		ref  string
+		user authenticationv1.UserInfo
+		want bool
+	}{
+		{ref: "jane", user: jane, want: true},
+		{ref: "user.jane", user: jane, want: true},
+		{ref: "john", user: jane},
+		{ref: "group.devs", user: jane, want: true},
+		{ref: "group.ops", user: jane},
+		{ref: "uid.1234", user: jane, want: true},
+		{ref: "uid.5678", user: jane},
+		{ref: "uid:1234", user: authenticationv1.UserInfo{Username: "jane"}},
+		{ref: "sa.ns.deployer", user: deployer, want: true},
+		{ref: "system:serviceaccount:ns:deployer", user: deployer, want: true},
+		{ref: "sa.other.deployer", user: deployer},
+		// A user named like a service account is not the service account.
+		{ref: "sa.ns.deployer", user: authenticationv1.UserInfo{Username: "sa.ns.deployer"}},
+	}
+	for _, tt := range tests {
+		o, err := parseOwner(tt.ref)
+		if err != nil {
+			t.Fatalf("parseOwner(%q) failed: %v", tt.ref, err)
+		}
+		if got := o.matches(tt.user); got != tt.want {
+			t.Errorf("%q matches %+v = %v, want %v", tt.ref, tt.user, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/jsonpointer"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	heimdallPolicyGVR = schema.GroupVersionResource{Group: "heimdall.io", Version: "v1alpha1", Resource: "heimdallpolicies"}
+	namespaceGVR      = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+	// defaultProtectedPaths apply to owned resources not selected by any HeimdallPolicy.
+	defaultProtectedPaths = []string{"/spec", "/metadata/labels"}
+
+	// serverManagedPaths are metadata set by the API server, which changes with every update.
+	serverManagedPaths = []string{
+		"/metadata/resourceVersion",
+		"/metadata/generation",
+		"/metadata/managedFields",
+		"/metadata/uid",
+		"/metadata/creationTimestamp",
+		"/metadata/selfLink",
+	}
+
+	// heimdallMetadataPaths are the Heimdall labels and annotations, whose changes are governed by the ownership rules.
+	heimdallMetadataPaths = []string{
+		"/metadata/labels/" + jsonpointer.Escape(ownerLabel),
+		"/metadata/labels/" + jsonpointer.Escape(priorityLabel),
+		"/metadata/annotations/" + jsonpointer.Escape(ownerAnnotation),
+		"/metadata/annotations/" + jsonpointer.Escape(successorAnnotation),
+	}
+)
+
+// HeimdallPolicy is a cluster-scoped custom resource declaring which fields of the owned resources it selects are
+// protected against changes by non-owners.
+type HeimdallPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec HeimdallPolicySpec `json:"spec"`
+}
+
+// HeimdallPolicySpec is the specification of a HeimdallPolicy.
+type HeimdallPolicySpec struct {
+	// Match selects the resources the policy applies to.
+	Match PolicyMatch `json:"match"`
+	// ProtectedPaths are JSON pointers to the values only the owner may change, e.g. /spec or /data.
+	ProtectedPaths []string `json:"protectedPaths"`
+	// IgnoredPaths are JSON pointers to values within the protected paths that anyone may change, e.g. /spec/replicas.
+	IgnoredPaths []string `json:"ignoredPaths,omitempty"`
+	// Enforcement is the enforcement mode for violations: enforce (the default), revert, warn or audit.
+	Enforcement string `json:"enforcement,omitempty"`
+}
+
+// PolicyMatch selects resources by kind, namespace labels and object labels. Empty criteria match everything.
+type PolicyMatch struct {
+	Resources         []PolicyResource      `json:"resources,omitempty"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	ObjectSelector    *metav1.LabelSelector `json:"objectSelector,omitempty"`
+}
+
+// PolicyResource selects resources by group, version and kind. An empty version, or `*` for any of the fields, matches
+// any value. The core API group is the empty string.
+type PolicyResource struct {
+	Group   string `json:"group"`
+	Version string `json:"version,omitempty"`
+	Kind    string `json:"kind"`
+}
+
+func (r PolicyResource) matches(gvk metav1.GroupVersionKind) bool {
+	return (r.Group == "*" || r.Group == gvk.Group) &&
+		(r.Version == "" || r.Version == "*" || r.Version == gvk.Version) &&
+		(r.Kind == "*" || r.Kind == gvk.Kind)
+}
+
+// policy is a HeimdallPolicy compiled for evaluation.
+type policy struct {
+	name              string
+	resources         []PolicyResource
+	namespaceSelector labels.Selector
+	objectSelector    labels.Selector
+	protectedPaths    []string
+	ignoredPaths      []string
+	mode              enforcementMode
+}
+
+func compilePolicy(hp *HeimdallPolicy) (*policy, error) {
+	p := &policy{
+		name:              hp.Name,
+		resources:         hp.Spec.Match.Resources,
+		namespaceSelector: labels.Everything(),
+		objectSelector:    labels.Everything(),
+		protectedPaths:    hp.Spec.ProtectedPaths,
+		ignoredPaths:      hp.Spec.IgnoredPaths,
+		mode:              enforcementEnforce,
+	}
+	var err error
+	if hp.Spec.Enforcement != "" {
+		if p.mode, err = parseEnforcementMode(hp.Spec.Enforcement); err != nil {
+			return nil, err
+		}
+	}
+	if hp.Spec.Match.NamespaceSelector != nil {
+		if p.namespaceSelector, err = metav1.LabelSelectorAsSelector(hp.Spec.Match.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %v", err)
+		}
+	}
+	if hp.Spec.Match.ObjectSelector != nil {
+		if p.objectSelector, err = metav1.LabelSelectorAsSelector(hp.Spec.Match.ObjectSelector); err != nil {
+			return nil, fmt.Errorf("invalid object selector: %v", err)
+		}
+	}
+	if len(p.protectedPaths) == 0 {
+		return nil, fmt.Errorf("no protected paths")
+	}
+	for _, path := range append(append([]string{}, p.protectedPaths...), p.ignoredPaths...) {
+		if _, err := jsonpointer.Parse(path); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *policy) matches(gvk metav1.GroupVersionKind, namespaceLabels, objectLabels labels.Set) bool {
+	if len(p.resources) > 0 {
+		matched := false
+		for _, r := range p.resources {
+			if r.matches(gvk) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return p.namespaceSelector.Matches(namespaceLabels) && p.objectSelector.Matches(objectLabels)
+}
+
+// protection is the effective protection of a resource, made up of the rules of all policies that select it.
+type protection struct {
+	policies []string
+	rules    []protectionRule
+	mode     enforcementMode
+}
+
+// protectionRule protects the values at the protected paths, except for those at the ignored paths.
+type protectionRule struct {
+	protectedPaths []string
+	ignoredPaths   []string
+}
+
+func defaultProtection(mode enforcementMode) *protection {
+	return &protection{
+		rules: []protectionRule{{protectedPaths: defaultProtectedPaths}},
+		mode:  mode,
+	}
+}
+
+// String describes the origin of the protection for log and denial messages.
+func (p *protection) String() string {
+	if len(p.policies) == 0 {
+		return "default policy"
+	}
+	return "HeimdallPolicy " + strings.Join(p.policies, ", ")
+}
+
+// violations returns the JSON pointers of the protected values that differ between the existing and the new object.
+func (p *protection) violations(existingObj, newObj *unstructured.Unstructured) []string {
+	seen := make(map[string]bool)
+	var violations []string
+	for _, rule := range p.rules {
+		for _, path := range rule.protectedPaths {
+			tokens, err := jsonpointer.Parse(path)
+			if err != nil {
+				continue
+			}
+			existingValue, _ := jsonpointer.Lookup(existingObj.Object, tokens)
+			newValue, _ := jsonpointer.Lookup(newObj.Object, tokens)
+			for _, change := range jsonpointer.Diff(existingValue, newValue, path, nil) {
+				if !seen[change] && !rule.ignored(change) {
+					seen[change] = true
+					violations = append(violations, change)
+				}
+			}
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// snapshotPaths returns the paths recorded in the snapshot of an owner-approved state: the protected paths of all
+// rules, and the paths within them that are not protected, i.e., server-managed and Heimdall metadata and the ignored
+// paths that no other rule protects.
+func (p *protection) snapshotPaths() (protected, excluded []string) {
+	excluded = append(append(excluded, serverManagedPaths...), heimdallMetadataPaths...)
+	for _, rule := range p.rules {
+		protected = append(protected, rule.protectedPaths...)
+		for _, path := range rule.ignoredPaths {
+			if !p.protects(path) {
+				excluded = append(excluded, path)
+			}
+		}
+	}
+	return protected, excluded
+}
+
+// protects checks if any rule protects the value at the given JSON pointer.
+func (p *protection) protects(pointer string) bool {
+	for _, rule := range p.rules {
+		if jsonpointer.IsUnderAny(pointer, rule.protectedPaths) && !rule.ignored(pointer) {
+			return true
+		}
+	}
+	return false
+}
+
+// isServerManaged checks if the given JSON pointer refers to server-managed metadata.
+func isServerManaged(pointer string) bool {
+	return jsonpointer.IsUnderAny(pointer, serverManagedPaths)
+}
+
+// ignored checks if the given JSON pointer is not protected by the rule. Server-managed and Heimdall metadata are
+// never protected.
+func (r protectionRule) ignored(pointer string) bool {
+	return isServerManaged(pointer) || jsonpointer.IsUnderAny(pointer, heimdallMetadataPaths) ||
+		jsonpointer.IsUnderAny(pointer, r.ignoredPaths)
+}
+
+// policyStore keeps the HeimdallPolicies of the cluster, kept up to date by an informer, along with a cache of
+// namespace labels for evaluating namespace selectors.
+type policyStore struct {
+	mu       sync.RWMutex
+	policies map[string]*policy
+
+	namespaces cache.GenericLister
+	// defaultMode is the enforcement mode for resources not selected by any policy.
+	defaultMode enforcementMode
+}
+
+// newPolicyStore creates a policy store and starts the informers watching HeimdallPolicies and namespaces. It blocks
+// until the informer caches are synced.
+func newPolicyStore(client dynamic.Interface, defaultMode enforcementMode, stopCh <-chan struct{}) (*policyStore, error) {
+	s := &policyStore{
+		policies:    make(map[string]*policy),
+		defaultMode: defaultMode,
+	}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 10*time.Minute)
+	policyInformer := factory.ForResource(heimdallPolicyGVR).Informer()
+	if _, err := policyInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.onPolicyChange,
+		UpdateFunc: func(_, obj interface{}) { s.onPolicyChange(obj) },
+		DeleteFunc: s.onPolicyDelete,
+	}); err != nil {
+		return nil, err
+	}
+	s.namespaces = factory.ForResource(namespaceGVR).Lister()
+
+	factory.Start(stopCh)
+	for gvr, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync informer cache for %s", gvr)
+		}
+	}
+	return s, nil
+}
+
+func (s *policyStore) onPolicyChange(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	hp := &HeimdallPolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, hp); err != nil {
+		logrus.Errorf("ignoring malformed HeimdallPolicy %s: %v", u.GetName(), err)
+		s.remove(u.GetName())
+		return
+	}
+	p, err := compilePolicy(hp)
+	if err != nil {
+		logrus.Errorf("ignoring invalid HeimdallPolicy %s: %v", hp.Name, err)
+		s.remove(hp.Name)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[p.name] = p
+	logrus.Infof("applied HeimdallPolicy %s", p.name)
+}
+
+func (s *policyStore) onPolicyDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		s.remove(u.GetName())
+		logrus.Infof("removed HeimdallPolicy %s", u.GetName())
+	}
+}
+
+func (s *policyStore) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, name)
+}
+
+// protectionFor returns the effective protection of the given object, merging all policies that select it. Objects
+// not selected by any policy get the default protection. The strictest enforcement mode of the policies applies,
+// unless the enforcement label of the namespace sets a stricter one.
+func (s *policyStore) protectionFor(gvk metav1.GroupVersionKind, namespace string, obj *unstructured.Unstructured) *protection {
+	if s == nil {
+		return defaultProtection(enforcementEnforce)
+	}
+
+	namespaceLabels := labels.Set{}
+	if namespace != "" && s.namespaces != nil {
+		if ns, err := s.namespaces.Get(namespace); err == nil {
+			if u, ok := ns.(*unstructured.Unstructured); ok {
+				namespaceLabels = u.GetLabels()
+			}
+		}
+	}
+	objectLabels := labels.Set(obj.GetLabels())
+
+	s.mu.RLock()
+	prot := &protection{}
+	for _, p := range s.policies {
+		if !p.matches(gvk, namespaceLabels, objectLabels) {
+			continue
+		}
+		prot.policies = append(prot.policies, p.name)
+		prot.rules = append(prot.rules, protectionRule{protectedPaths: p.protectedPaths, ignoredPaths: p.ignoredPaths})
+		if p.mode.strictness() >= prot.mode.strictness() {
+			prot.mode = p.mode
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(prot.policies) == 0 {
+		prot = defaultProtection(s.defaultMode)
+	}
+	sort.Strings(prot.policies)
+
+	if label := namespaceLabels[enforcementLabel]; label != "" {
+		mode, err := parseEnforcementMode(label)
+		switch {
+		case err != nil:
+			logrus.Errorf("ignoring enforcement label of namespace %s: %v", namespace, err)
+		case mode.strictness() > prot.mode.strictness():
+			prot.mode = mode
+		case mode != prot.mode:
+			logrus.Warnf("ignoring enforcement label %s of namespace %s, which is less strict than %s of %s",
+				mode, namespace, prot.mode, prot)
+		}
+	}
+	return prot
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"testing"
+)
+
+var (
+	deploymentGVK = metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	configMapGVK  = metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+)
+
+// newTestPolicyStore returns a policy store with the given policies and namespaces, without informers.
+func newTestPolicyStore(t *testing.T, defaultMode enforcementMode, namespaces []*unstructured.Unstructured, policies ...*HeimdallPolicy) *policyStore {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		if err := indexer.Add(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &policyStore{
+		policies:    make(map[string]*policy),
+		namespaces:  cache.NewGenericLister(indexer, namespaceGVR.GroupResource()),
+		defaultMode: defaultMode,
+	}
+	for _, hp := range policies {
+		p, err := compilePolicy(hp)
+		if err != nil {
+			t.Fatalf("compilePolicy(%s) failed: %v", hp.Name, err)
+		}
+		s.policies[p.name] = p
+	}
+	return s
+}
+
+func newTestNamespace(name string, nsLabels map[string]string) *unstructured.Unstructured {
+	ns := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Namespace"}}
+	ns.SetName(name)
+	ns.SetLabels(nsLabels)
+	return ns
+}
+
+func newTestPolicy(name string, spec HeimdallPolicySpec) *HeimdallPolicy {
+	return &HeimdallPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+}
+
+func TestCompilePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     HeimdallPolicySpec
+		wantMode enforcementMode
+		wantErr  bool
+	}{
+		{name: "defaults to enforce", spec: HeimdallPolicySpec{ProtectedPaths: []string{"/spec"}}, wantMode: enforcementEnforce},
+		{name: "explicit mode", spec: HeimdallPolicySpec{ProtectedPaths: []string{"/spec"}, Enforcement: "warn"}, wantMode: enforcementWarn},
+		{name: "invalid mode", spec: HeimdallPolicySpec{ProtectedPaths: []string{"/spec"}, Enforcement: "block"}, wantErr: true},
+		{name: "no protected paths", spec: HeimdallPolicySpec{}, wantErr: true},
+		{name: "invalid protected path", spec: HeimdallPolicySpec{ProtectedPaths: []string{"spec"}}, wantErr: true},
+		{name: "invalid ignored path", spec: HeimdallPolicySpec{ProtectedPaths: []string{"/spec"}, IgnoredPaths: []string{"spec/replicas"}}, wantErr: true},
+		{
+			name: "invalid namespace selector",
+			spec: HeimdallPolicySpec{
+				ProtectedPaths: []string{"/spec"},
+				Match: PolicyMatch{NamespaceSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Matches"}},
+				}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid object selector",
+			spec: HeimdallPolicySpec{
+				ProtectedPaths: []string{"/spec"},
+				Match:          PolicyMatch{ObjectSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"in valid": "x"}}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		p, err := compilePolicy(newTestPolicy("test", tt.spec))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: compilePolicy succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: compilePolicy failed: %v", tt.name, err)
+			continue
+		}
+		if p.mode != tt.wantMode {
+			t.Errorf("%s: mode = %s, want %s", tt.name, p.mode, tt.wantMode)
+		}
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	tests := []struct {
+		name            string
+		match           PolicyMatch
+		gvk             metav1.GroupVersionKind
+		namespaceLabels labels.Set
+		objectLabels    labels.Set
+		want            bool
+	}{
+		{name: "empty match", gvk: deploymentGVK, want: true},
+		{name: "kind", match: PolicyMatch{Resources: []PolicyResource{{Group: "apps", Kind: "Deployment"}}}, gvk: deploymentGVK, want: true},
+		{name: "other kind", match: PolicyMatch{Resources: []PolicyResource{{Group: "apps", Kind: "Deployment"}}}, gvk: configMapGVK},
+		{name: "other group", match: PolicyMatch{Resources: []PolicyResource{{Group: "", Kind: "Deployment"}}}, gvk: deploymentGVK},
+		{name: "version", match: PolicyMatch{Resources: []PolicyResource{{Group: "apps", Version: "v1", Kind: "Deployment"}}}, gvk: deploymentGVK, want: true},
+		{name: "other version", match: PolicyMatch{Resources: []PolicyResource{{Group: "apps", Version: "v1beta1", Kind: "Deployment"}}}, gvk: deploymentGVK},
+		{name: "wildcards", match: PolicyMatch{Resources: []PolicyResource{{Group: "*", Version: "*", Kind: "*"}}}, gvk: configMapGVK, want: true},
+		{name: "any resource", match: PolicyMatch{Resources: []PolicyResource{{Group: "apps", Kind: "Deployment"}, {Kind: "ConfigMap"}}}, gvk: configMapGVK, want: true},
+		{
+			name:            "namespace selector",
+			match:           PolicyMatch{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}},
+			gvk:             deploymentGVK,
+			namespaceLabels: labels.Set{"team": "payments"},
+			want:            true,
+		},
+		{
+			name:            "namespace selector mismatch",
+			match:           PolicyMatch{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}},
+			gvk:             deploymentGVK,
+			namespaceLabels: labels.Set{"team": "search"},
+		},
+		{
+			name:         "object selector",
+			match:        PolicyMatch{ObjectSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "critical"}}},
+			gvk:          deploymentGVK,
+			objectLabels: labels.Set{"tier": "critical"},
+			want:         true,
+		},
+		{
+			name:  "object selector without labels",
+			match: PolicyMatch{ObjectSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "critical"}}},
+			gvk:   deploymentGVK,
+		},
+	}
+	for _, tt := range tests {
+		p, err := compilePolicy(newTestPolicy("test", HeimdallPolicySpec{Match: tt.match, ProtectedPaths: []string{"/spec"}}))
+		if err != nil {
+			t.Fatalf("%s: compilePolicy failed: %v", tt.name, err)
+		}
+		if got := p.matches(tt.gvk, tt.namespaceLabels, tt.objectLabels); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProtectionViolations(t *testing.T) {
+	existing := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":          map[string]interface{}{ownerLabel: "jane", "app": "web"},
+			"resourceVersion": "1",
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(2),
+			"template": map[string]interface{}{"image": "web:1"},
+		},
+		"data": map[string]interface{}{"key": "value"},
+	}
+	tests := []struct {
+		name  string
+		rules []protectionRule
+		// mutate changes a copy of the existing object into the new object.
+		mutate func(obj *unstructured.Unstructured)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			rules:  []protectionRule{{protectedPaths: defaultProtectedPaths}},
+			mutate: func(obj *unstructured.Unstructured) {},
+		},
+		{
+			name:  "protected value changed",
+			rules: []protectionRule{{protectedPaths: defaultProtectedPaths}},
+			mutate: func(obj *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(obj.Object, "web:2", "spec", "template", "image")
+			},
+			want: []string{"/spec/template/image"},
+		},
+		{
+			name:  "protected value removed and added",
+			rules: []protectionRule{{protectedPaths: defaultProtectedPaths}},
+			mutate: func(obj *unstructured.Unstructured) {
+				unstructured.RemoveNestedField(obj.Object, "spec", "replicas")
+				_ = unstructured.SetNestedField(obj.Object, "true", "spec", "paused")
+			},
+			want: []string{"/spec/paused", "/spec/replicas"},
+		},
+		{
+			name:  "unprotected value changed",
+			rules: []protectionRule{{protectedPaths: []string{"/spec"}}},
+			mutate: func(obj *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(obj.Object, "other", "data", "key")
+			},
+		},
+		{
+			name:  "ignored value changed",
+			rules: []protectionRule{{protectedPaths: []string{"/spec"}, ignoredPaths: []string{"/spec/replicas"}}},
+			mutate: func(obj *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(obj.Object, int64(5), "spec", "replicas")
+			},
+		},
+		{
+			name: "ignored value protected by another rule",
+			rules: []protectionRule{
+				{protectedPaths: []string{"/spec"}, ignoredPaths: []string{"/spec/replicas"}},
+				{protectedPaths: []string{"/spec/replicas"}},
+			},
+			mutate: func(obj *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(obj.Object, int64(5), "spec", "replicas")
+			},
+			want: []string{"/spec/replicas"},
+		},
+		{
+			name:  "server-managed and Heimdall metadata",
+			rules: []protectionRule{{protectedPaths: []string{"/metadata"}}},
+			mutate: func(obj *unstructured.Unstructured) {
+				obj.SetResourceVersion("2")
+				_ = unstructured.SetNestedField(obj.Object, "john", "metadata", "labels", ownerLabel)
+				_ = unstructured.SetNestedField(obj.Object, "api", "metadata", "labels", "app")
+			},
+			want: []string{"/metadata/labels/app"},
+		},
+		{
+			name: "overlapping rules report each change once",
+			rules: []protectionRule{
+				{protectedPaths: []string{"/spec"}},
+				{protectedPaths: []string{"/spec/template"}},
+			},
+			mutate: func(obj *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(obj.Object, "web:2", "spec", "template", "image")
+			},
+			want: []string{"/spec/template/image"},
+		},
+	}
+	for _, tt := range tests {
+		existingObj := &unstructured.Unstructured{Object: existing}
+		newObj := existingObj.DeepCopy()
+		tt.mutate(newObj)
+		prot := &protection{rules: tt.rules}
+		if got := prot.violations(existingObj, newObj); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: violations = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProtectionFor(t *testing.T) {
+	namespaces := []*unstructured.Unstructured{
+		newTestNamespace("payments", map[string]string{"team": "payments"}),
+		newTestNamespace("search", map[string]string{"team": "search"}),
+	}
+	store := newTestPolicyStore(t, enforcementWarn, namespaces,
+		newTestPolicy("deployments", HeimdallPolicySpec{
+			Match:          PolicyMatch{Resources: []PolicyResource{{Group: "apps", Kind: "Deployment"}}},
+			ProtectedPaths: []string{"/spec/template"},
+			Enforcement:    "audit",
+		}),
+		newTestPolicy("payments", HeimdallPolicySpec{
+			Match: PolicyMatch{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			},
+			ProtectedPaths: []string{"/spec", "/data"},
+			IgnoredPaths:   []string{"/spec/replicas"},
+			Enforcement:    "revert",
+		}),
+	)
+
+	tests := []struct {
+		name         string
+		gvk          metav1.GroupVersionKind
+		namespace    string
+		wantPolicies []string
+		wantRules    []protectionRule
+		wantMode     enforcementMode
+	}{
+		{
+			name:      "not selected",
+			gvk:       configMapGVK,
+			namespace: "search",
+			wantRules: []protectionRule{{protectedPaths: defaultProtectedPaths}},
+			wantMode:  enforcementWarn,
+		},
+		{
+			name:         "selected by kind",
+			gvk:          deploymentGVK,
+			namespace:    "search",
+			wantPolicies: []string{"deployments"},
+			wantRules:    []protectionRule{{protectedPaths: []string{"/spec/template"}}},
+			wantMode:     enforcementAudit,
+		},
+		{
+			name:         "selected by namespace",
+			gvk:          configMapGVK,
+			namespace:    "payments",
+			wantPolicies: []string{"payments"},
+			wantRules:    []protectionRule{{protectedPaths: []string{"/spec", "/data"}, ignoredPaths: []string{"/spec/replicas"}}},
+			wantMode:     enforcementRevert,
+		},
+		{
+			name:         "merged with the strictest mode",
+			gvk:          deploymentGVK,
+			namespace:    "payments",
+			wantPolicies: []string{"deployments", "payments"},
+			wantRules: []protectionRule{
+				{protectedPaths: []string{"/spec/template"}},
+				{protectedPaths: []string{"/spec", "/data"}, ignoredPaths: []string{"/spec/replicas"}},
+			},
+			wantMode: enforcementRevert,
+		},
+		{
+			name:      "unknown namespace",
+			gvk:       configMapGVK,
+			namespace: "unknown",
+			wantRules: []protectionRule{{protectedPaths: defaultProtectedPaths}},
+			wantMode:  enforcementWarn,
+		},
+	}
+	for _, tt := range tests {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		prot := store.protectionFor(tt.gvk, tt.namespace, obj)
+		if !reflect.DeepEqual(prot.policies, tt.wantPolicies) {
+			t.Errorf("%s: policies = %v, want %v", tt.name, prot.policies, tt.wantPolicies)
+		}
+		// Policies are kept in a map, so their rules are merged in any order.
+		if len(prot.rules) != len(tt.wantRules) {
+			t.Errorf("%s: rules = %+v, want %+v", tt.name, prot.rules, tt.wantRules)
+		}
+		for _, want := range tt.wantRules {
+			found := false
+			for _, rule := range prot.rules {
+				found = found || reflect.DeepEqual(rule, want)
+			}
+			if !found {
+				t.Errorf("%s: rules = %+v, want %+v", tt.name, prot.rules, tt.wantRules)
+			}
+		}
+		if prot.mode != tt.wantMode {
+			t.Errorf("%s: mode = %s, want %s", tt.name, prot.mode, tt.wantMode)
+		}
+	}
+}
+
+func TestProtectionSnapshotPaths(t *testing.T) {
+	prot := &protection{rules: []protectionRule{
+		{protectedPaths: []string{"/spec"}, ignoredPaths: []string{"/spec/replicas", "/spec/paused"}},
+		{protectedPaths: []string{"/spec/paused"}},
+	}}
+	protected, excluded := prot.snapshotPaths()
+	if want := []string{"/spec", "/spec/paused"}; !reflect.DeepEqual(protected, want) {
+		t.Errorf("protected = %v, want %v", protected, want)
+	}
+	if !containsString(excluded, "/spec/replicas") {
+		t.Errorf("excluded = %v, want it to contain /spec/replicas", excluded)
+	}
+	if containsString(excluded, "/spec/paused") {
+		t.Errorf("excluded = %v, want it not to contain /spec/paused, which another rule protects", excluded)
+	}
+	for _, path := range append(append([]string{}, serverManagedPaths...), heimdallMetadataPaths...) {
+		if !containsString(excluded, path) {
+			t.Errorf("excluded = %v, want it to contain %s", excluded, path)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProtectionForNamespaceEnforcementLabel(t *testing.T) {
+	namespaces := []*unstructured.Unstructured{
+		newTestNamespace("strict", map[string]string{"team": "payments", enforcementLabel: "enforce"}),
+		newTestNamespace("lax", map[string]string{"team": "payments", enforcementLabel: "audit"}),
+		newTestNamespace("invalid", map[string]string{"team": "payments", enforcementLabel: "off"}),
+		newTestNamespace("unselected-lax", map[string]string{enforcementLabel: "warn"}),
+	}
+	store := newTestPolicyStore(t, enforcementRevert, namespaces,
+		newTestPolicy("payments", HeimdallPolicySpec{
+			Match: PolicyMatch{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			},
+			ProtectedPaths: []string{"/spec"},
+			Enforcement:    "warn",
+		}),
+	)
+
+	tests := []struct {
+		namespace string
+		want      enforcementMode
+	}{
+		// The label tightens the mode of the policies.
+		{namespace: "strict", want: enforcementEnforce},
+		// It cannot loosen the mode of the policies or the default mode.
+		{namespace: "lax", want: enforcementWarn},
+		{namespace: "unselected-lax", want: enforcementRevert},
+		{namespace: "invalid", want: enforcementWarn},
+	}
+	for _, tt := range tests {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		if got := store.protectionFor(deploymentGVK, tt.namespace, obj).mode; got != tt.want {
+			t.Errorf("mode in namespace %s = %s, want %s", tt.namespace, got, tt.want)
+		}
+	}
+}
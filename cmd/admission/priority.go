@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
+	"time"
+)
+
+// priorityHeader is the Kafka header carrying the priority of a reconcile request.
+const priorityHeader = "heimdall-priority"
+
+// eventPriority returns the priority of the resource of the given event, def if its label is missing or invalid.
+func eventPriority(event *reconcile.Event, def priority.Priority) priority.Priority {
+	if p, err := priority.Parse(event.Priority); err == nil {
+		return p
+	}
+	return def
+}
+
+// parsePriorityDurations parses a list of priority=duration entries, e.g. critical=1s.
+func parsePriorityDurations(entries []string) (map[priority.Priority]time.Duration, error) {
+	durations := make(map[priority.Priority]time.Duration)
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, must be priority=duration", entry)
+		}
+		p, err := priority.Parse(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for priority %s: %v", p, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid duration for priority %s: must be positive", p)
+		}
+		durations[p] = d
+	}
+	return durations, nil
+}
+
+// validatePriorityLabel checks the priority label of a created or updated resource. Labels that the request does not
+// change are not checked, so that resources labelled before the priorities were enforced can still be updated.
+func validatePriorityLabel(existingObj, newObj *unstructured.Unstructured) error {
+	value, ok := newObj.GetLabels()[priorityLabel]
+	if !ok {
+		return nil
+	}
+	if existingObj != nil {
+		if old, had := existingObj.GetLabels()[priorityLabel]; had && old == value {
+			return nil
+		}
+	}
+	if _, err := priority.Parse(value); err != nil {
+		return fmt.Errorf("label %s: %v", priorityLabel, err)
+	}
+	return nil
+}
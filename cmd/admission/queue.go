@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// queueFullPolicy determines what happens when a reconcile request is published while the queue is full.
+type queueFullPolicy string
+
+const (
+	// queueFullBlock waits for room in the queue, up to the block timeout, and fails the admission afterwards.
+	queueFullBlock queueFullPolicy = "block"
+	// queueFullDropOldest drops the oldest queued request to make room.
+	queueFullDropOldest queueFullPolicy = "drop-oldest"
+	// queueFullFail fails the admission right away.
+	queueFullFail queueFullPolicy = "fail"
+)
+
+const (
+	// retryInterval is how long a worker waits before retrying to hand a message to a disconnected producer.
+	retryInterval = time.Second
+	// replayAckTimeout is how long replaying the spool waits for the delivery of a message before sending it again.
+	replayAckTimeout = 30 * time.Second
+)
+
+var (
+	errQueueClosed  = errors.New("reconcile queue is closed")
+	errQueueDropped = errors.New("reconcile request dropped from the full reconcile queue")
+)
+
+func parseQueueFullPolicy(s string) (queueFullPolicy, error) {
+	switch policy := queueFullPolicy(s); policy {
+	case queueFullBlock, queueFullDropOldest, queueFullFail:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid queue full policy %q, must be one of %s, %s or %s", s,
+		queueFullBlock, queueFullDropOldest, queueFullFail)
+}
+
+// reconcileQueue decouples admission requests from publishing: the admit path hands reconcile requests to a bounded
+// in-process queue, which background workers drain into the asynchronous Kafka producer.
+//
+// If a spool is configured, reconcile requests that cannot be delivered are written to it instead of being retried or
+// discarded, and replayed once Kafka is available, highest priority first and in order within a priority. While the
+// spool holds requests of a priority, new ones of that priority are appended to it as well, so that they are not
+// published ahead of older ones. A spooled request counts as delivered, as it is no longer lost if Kafka is not
+// available.
+type reconcileQueue struct {
+	producer     *reconcileProducer
+	spool        *prioritySpool
+	items        chan *kafkaMessage
+	fullPolicy   queueFullPolicy
+	blockTimeout time.Duration
+
+	// closeMu guards closed: enqueues hold it for reading, so that items is never closed while being sent to.
+	closeMu sync.RWMutex
+	closed  bool
+	stopCh  chan struct{}
+	// wg tracks the workers, replayWg the goroutine replaying the spool.
+	wg       sync.WaitGroup
+	replayWg sync.WaitGroup
+}
+
+// newReconcileQueue creates the queue and starts its workers. spool may be nil.
+func newReconcileQueue(producer *reconcileProducer, spool *prioritySpool, size, workers int, fullPolicy queueFullPolicy, blockTimeout time.Duration) *reconcileQueue {
+	q := &reconcileQueue{
+		producer:     producer,
+		spool:        spool,
+		items:        make(chan *kafkaMessage, size),
+		fullPolicy:   fullPolicy,
+		blockTimeout: blockTimeout,
+		stopCh:       make(chan struct{}),
+	}
+	expvar.Publish("heimdall_reconcile_queue_depth", expvar.Func(func() interface{} { return len(q.items) }))
+	expvar.Publish("heimdall_reconcile_queue_capacity", expvar.Func(func() interface{} { return cap(q.items) }))
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	if spool != nil {
+		q.replayWg.Add(1)
+		go q.replay()
+	}
+	return q
+}
+
+// enqueue hands a message to the queue, applying the queue full policy if there is no room.
+func (q *reconcileQueue) enqueue(msg *kafkaMessage) error {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+	if q.closed {
+		return errQueueClosed
+	}
+
+	select {
+	case q.items <- msg:
+		metricQueueEnqueued.Add(1)
+		return nil
+	default:
+	}
+
+	switch q.fullPolicy {
+	case queueFullDropOldest:
+		for {
+			select {
+			case q.items <- msg:
+				metricQueueEnqueued.Add(1)
+				return nil
+			case dropped := <-q.items:
+				dropped.delivered(errQueueDropped)
+				metricQueueDropped.Add(1)
+				logrus.Warnf("reconcile queue full, dropped oldest reconcile request")
+			}
+		}
+
+	case queueFullBlock:
+		timer := time.NewTimer(q.blockTimeout)
+		defer timer.Stop()
+		select {
+		case q.items <- msg:
+			metricQueueEnqueued.Add(1)
+			return nil
+		case <-timer.C:
+		}
+	}
+
+	metricQueueRejected.Add(1)
+	return fmt.Errorf("reconcile queue is full (%d requests)", cap(q.items))
+}
+
+func (q *reconcileQueue) work() {
+	defer q.wg.Done()
+	for msg := range q.items {
+		q.deliver(msg)
+	}
+}
+
+// deliver hands a message to the producer. Without a spool, it waits for the producer to (re)connect if needed. Once
+// the queue is closed, it gives up on the message rather than delaying shutdown.
+func (q *reconcileQueue) deliver(msg *kafkaMessage) {
+	if q.spool != nil {
+		if q.spool.pending(msg.Priority) {
+			msg.delivered(q.spoolMessage(msg))
+			return
+		}
+		if err := q.producer.send(msg, q.spoolOnFailure(msg)); err != nil {
+			msg.delivered(q.spoolMessage(msg))
+		}
+		return
+	}
+
+	for {
+		err := q.producer.send(msg, msg.delivered)
+		if err == nil {
+			return
+		}
+		select {
+		case <-q.stopCh:
+			metricKafkaFailed.Add(1)
+			logrus.Errorf("discarding reconcile request on shutdown: %v", err)
+			msg.delivered(err)
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// spoolOnFailure returns a delivery callback that writes the given message to the spool if it could not be delivered,
+// before reporting the delivery result: nil once the message reached Kafka or the spool.
+func (q *reconcileQueue) spoolOnFailure(msg *kafkaMessage) deliveryCallback {
+	return func(err error) {
+		if err != nil {
+			err = q.spoolMessage(msg)
+		}
+		msg.delivered(err)
+	}
+}
+
+// spoolMessage writes the given message to the spool, returning an error if it could not, in which case the message is
+// lost.
+func (q *reconcileQueue) spoolMessage(msg *kafkaMessage) error {
+	record, err := json.Marshal(msg)
+	if err == nil {
+		err = q.spool.append(msg.Priority, record)
+	}
+	if err != nil {
+		metricKafkaFailed.Add(1)
+		logrus.Errorf("discarding reconcile request, failed to spool it: %v", err)
+		return fmt.Errorf("failed to spool reconcile request: %v", err)
+	}
+	return nil
+}
+
+// replay publishes the spooled messages by priority and in order, one at a time, removing each from the spool once
+// Kafka received it.
+func (q *reconcileQueue) replay() {
+	defer q.replayWg.Done()
+
+	for {
+		record, next, ok, err := q.spool.peek()
+		if err != nil {
+			logrus.Errorf("failed to read reconcile spool: %v", err)
+		}
+		if ok && q.replayMessage(record) {
+			if err := q.spool.commit(next); err != nil {
+				logrus.Errorf("failed to save reconcile spool cursor: %v", err)
+			}
+			continue
+		}
+
+		select {
+		case <-q.stopCh:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// replayMessage sends a spooled message and waits for its delivery, reporting whether it succeeded. Unreadable
+// records count as delivered, so that they do not block the spool.
+func (q *reconcileQueue) replayMessage(record []byte) bool {
+	msg := &kafkaMessage{}
+	if err := json.Unmarshal(record, msg); err != nil {
+		metricKafkaFailed.Add(1)
+		logrus.Errorf("discarding unreadable spooled reconcile request: %v", err)
+		return true
+	}
+
+	acked := make(chan error, 1)
+	if err := q.producer.send(msg, func(err error) { acked <- err }); err != nil {
+		return false
+	}
+
+	timer := time.NewTimer(replayAckTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-acked:
+		return err == nil
+	case <-timer.C:
+		logrus.Warnf("no delivery result for spooled reconcile request after %s, sending it again", replayAckTimeout)
+	case <-q.stopCh:
+	}
+	return false
+}
+
+// Close stops accepting reconcile requests and waits for the workers to hand the queued ones to the producer, until
+// the given timeout expires. It stops replaying the spool.
+func (q *reconcileQueue) Close(timeout time.Duration) {
+	q.closeMu.Lock()
+	q.closed = true
+	close(q.items)
+	q.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	close(q.stopCh)
+	<-done
+	q.replayWg.Wait()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventComponent is the source component of the Kubernetes Events created by Heimdall.
+	eventComponent = "heimdall-admission"
+	// eventReason is the reason of the Kubernetes Events created by the events sink.
+	eventReason = "ReconcileQueued"
+	// eventTimeout bounds the creation of a Kubernetes Event.
+	eventTimeout = 5 * time.Second
+)
+
+// Sink receives the reconcile requests published by the admission controller.
+type Sink interface {
+	// Publish hands the reconcile request for the given resource to the sink, giving up once the context is done.
+	Publish(ctx context.Context, event *reconcile.Event) error
+	// Close flushes the pending reconcile requests and releases the resources of the sink.
+	Close() error
+}
+
+// sinkKind identifies a Sink backend in the configuration.
+type sinkKind string
+
+const (
+	// sinkKafka publishes to the Heimdall Kafka topic.
+	sinkKafka sinkKind = "kafka"
+	// sinkHTTP POSTs to an HTTP endpoint.
+	sinkHTTP sinkKind = "http"
+	// sinkFile appends to a JSON-lines file.
+	sinkFile sinkKind = "file"
+	// sinkEvents creates Kubernetes Events attached to the resource.
+	sinkEvents sinkKind = "events"
+)
+
+func parseSinkKind(s string) (sinkKind, error) {
+	switch kind := sinkKind(s); kind {
+	case sinkKafka, sinkHTTP, sinkFile, sinkEvents:
+		return kind, nil
+	}
+	return "", fmt.Errorf("invalid sink %q, must be one of %s, %s, %s or %s", s, sinkKafka, sinkHTTP, sinkFile, sinkEvents)
+}
+
+// newSink creates the sinks enabled in the configuration, fanning out to all of them if there are several.
+func newSink(cfg *config, clientset kubernetes.Interface, dynamicClient dynamic.Interface, stopCh <-chan struct{}) (Sink, error) {
+	var sinks multiSink
+	for _, kind := range cfg.sinks {
+		var sink Sink
+		var err error
+		switch kind {
+		case sinkKafka:
+			sink, err = newKafkaSink(cfg, dynamicClient, stopCh)
+		case sinkHTTP:
+			sink = newHTTPSink(cfg.httpSinkURL, cfg.httpSinkTimeout)
+		case sinkFile:
+			sink, err = newFileSink(cfg.fileSinkPath)
+		case sinkEvents:
+			sink = newEventSink(clientset)
+		}
+		if err != nil {
+			_ = sinks.Close()
+			return nil, fmt.Errorf("failed to create %s sink: %v", kind, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// multiSink fans reconcile requests out to several sinks.
+type multiSink []Sink
+
+// Publish hands the reconcile request to all sinks, failing if any of them fails.
+func (m multiSink) Publish(ctx context.Context, event *reconcile.Event) error {
+	var errs []string
+	for _, sink := range m {
+		if err := sink.Publish(ctx, event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Close closes all sinks, in reverse order.
+func (m multiSink) Close() error {
+	var errs []string
+	for i := len(m) - 1; i >= 0; i-- {
+		if err := m[i].Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// httpSink POSTs each reconcile request as JSON to an HTTP endpoint.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(url string, timeout time.Duration) *httpSink {
+	return &httpSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *httpSink) Publish(ctx context.Context, event *reconcile.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// fileSink appends each reconcile request as a line of JSON to a local file.
+type fileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Publish(_ context.Context, event *reconcile.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(line)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// eventSink records each reconcile request as a Kubernetes Event attached to the resource, so that it shows up in
+// `kubectl describe` and `kubectl get events`.
+type eventSink struct {
+	clientset kubernetes.Interface
+}
+
+func newEventSink(clientset kubernetes.Interface) *eventSink {
+	return &eventSink{clientset: clientset}
+}
+
+func (s *eventSink) Publish(ctx context.Context, event *reconcile.Event) error {
+	message := fmt.Sprintf("%s, resource queued for reconcile (message %s)", event.Reason, event.MessageID)
+	if err := createEvent(ctx, s.clientset, event, eventReason, message); err != nil {
+		return err
+	}
+	logrus.Infof("recorded %s event for resource %s/%s", eventReason, event.Namespace, event.Name)
+	return nil
+}
+
+// createEvent creates a warning Kubernetes Event with the given reason and message on the resource of a reconcile
+// event.
+func createEvent(ctx context.Context, clientset kubernetes.Interface, event *reconcile.Event, reason, message string) error {
+	// Events of cluster-scoped resources are recorded in the default namespace.
+	eventNamespace := event.Namespace
+	if eventNamespace == "" {
+		eventNamespace = metav1.NamespaceDefault
+	}
+
+	k8sEvent := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: event.Name + ".",
+			Namespace:    eventNamespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: schema.GroupVersion{Group: event.Group, Version: event.Version}.String(),
+			Kind:       event.Kind,
+			Namespace:  event.Namespace,
+			Name:       event.Name,
+			UID:        event.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: metav1.NewTime(event.Timestamp),
+		LastTimestamp:  metav1.NewTime(event.Timestamp),
+		Count:          1,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	_, err := clientset.CoreV1().Events(eventNamespace).Create(ctx, k8sEvent, metav1.CreateOptions{})
+	return err
+}
+
+func (s *eventSink) Close() error {
+	return nil
+}
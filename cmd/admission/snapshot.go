@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotQueueSize is the capacity of the queue of snapshot writes, beyond which snapshots are dropped.
+	snapshotQueueSize = 1024
+	// snapshotWriteTimeout bounds each write to the snapshot store.
+	snapshotWriteTimeout = 5 * time.Second
+)
+
+// snapshotStoreKind is a backend for the snapshots of the owner-approved state of resources.
+type snapshotStoreKind string
+
+const (
+	// snapshotStoreNone disables recording snapshots.
+	snapshotStoreNone snapshotStoreKind = "none"
+	// snapshotStoreMemory keeps the snapshots in memory, which is lost on restart and not shared with reconcilers.
+	snapshotStoreMemory snapshotStoreKind = "memory"
+	// snapshotStoreConfigMap and snapshotStoreSecret keep each snapshot in a ConfigMap or Secret in the snapshot
+	// namespace.
+	snapshotStoreConfigMap snapshotStoreKind = "configmap"
+	snapshotStoreSecret    snapshotStoreKind = "secret"
+	// snapshotStoreFile keeps each snapshot in a file in the snapshot directory.
+	snapshotStoreFile snapshotStoreKind = "file"
+)
+
+func parseSnapshotStoreKind(s string) (snapshotStoreKind, error) {
+	switch kind := snapshotStoreKind(s); kind {
+	case snapshotStoreNone, snapshotStoreMemory, snapshotStoreConfigMap, snapshotStoreSecret, snapshotStoreFile:
+		return kind, nil
+	}
+	return "", fmt.Errorf("invalid snapshot store %q, must be one of %s, %s, %s, %s or %s", s,
+		snapshotStoreNone, snapshotStoreMemory, snapshotStoreConfigMap, snapshotStoreSecret, snapshotStoreFile)
+}
+
+// newSnapshotStore creates the configured snapshot store, nil if recording snapshots is disabled.
+func newSnapshotStore(cfg *config, clientset kubernetes.Interface) (reconcile.SnapshotStore, error) {
+	retention := reconcile.Retention{MaxEntries: cfg.snapshotMaxEntries, MaxAge: cfg.snapshotMaxAge}
+	switch cfg.snapshotStore {
+	case snapshotStoreMemory:
+		return reconcile.NewMemorySnapshotStore(retention), nil
+	case snapshotStoreConfigMap:
+		return reconcile.NewConfigMapSnapshotStore(clientset, cfg.snapshotNamespace, retention), nil
+	case snapshotStoreSecret:
+		return reconcile.NewSecretSnapshotStore(clientset, cfg.snapshotNamespace, retention), nil
+	case snapshotStoreFile:
+		return reconcile.NewFileSnapshotStore(cfg.snapshotDir, retention)
+	}
+	return nil, nil
+}
+
+// snapshotWrite is a pending write to the snapshot store: storing snapshot, or deleting the snapshot of ref if
+// snapshot is nil.
+type snapshotWrite struct {
+	snapshot *reconcile.Snapshot
+	ref      reconcile.ResourceRef
+}
+
+// snapshotRecorder records the snapshots of owner-approved states in the background, so that admissions do not wait
+// for the store. A single worker writes them in order, so the snapshot of a later admission is never overwritten by an
+// earlier one. A nil recorder records nothing.
+type snapshotRecorder struct {
+	store reconcile.SnapshotStore
+	// maxHashes bounds hashes, which is reset when it is reached.
+	maxHashes int
+
+	writes chan snapshotWrite
+	// hashes are the hashes of the last snapshots written per resource, so that unchanged states are not rewritten.
+	// It is only accessed by the worker.
+	hashes map[reconcile.ResourceRef]string
+
+	closeOnce sync.Once
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newSnapshotRecorder creates the recorder and starts its worker and the periodic pruning of the store.
+func newSnapshotRecorder(store reconcile.SnapshotStore, maxHashes int, pruneInterval time.Duration) *snapshotRecorder {
+	r := &snapshotRecorder{
+		store:     store,
+		maxHashes: maxHashes,
+		writes:    make(chan snapshotWrite, snapshotQueueSize),
+		hashes:    make(map[reconcile.ResourceRef]string),
+		stopCh:    make(chan struct{}),
+	}
+	r.wg.Add(2)
+	go r.run()
+	go r.pruneLoop(pruneInterval)
+	return r
+}
+
+// record queues the given snapshot for writing, dropping it if the queue is full.
+func (r *snapshotRecorder) record(snapshot *reconcile.Snapshot) {
+	r.enqueue(snapshotWrite{snapshot: snapshot, ref: snapshot.ResourceRef})
+}
+
+// forget queues the deletion of the snapshot of the given resource.
+func (r *snapshotRecorder) forget(ref reconcile.ResourceRef) {
+	r.enqueue(snapshotWrite{ref: ref})
+}
+
+func (r *snapshotRecorder) enqueue(write snapshotWrite) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.writes <- write:
+	default:
+		logrus.Warnf("snapshot queue is full, dropping the snapshot write for %s", write.ref)
+		metricSnapshotsDropped.Add(1)
+	}
+}
+
+func (r *snapshotRecorder) run() {
+	defer r.wg.Done()
+	for {
+		select {
+		case write := <-r.writes:
+			r.write(write)
+		case <-r.stopCh:
+			// Drain the writes queued before closing.
+			for {
+				select {
+				case write := <-r.writes:
+					r.write(write)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *snapshotRecorder) write(write snapshotWrite) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotWriteTimeout)
+	defer cancel()
+
+	if write.snapshot == nil {
+		delete(r.hashes, write.ref)
+		if err := r.store.Delete(ctx, write.ref); err != nil {
+			logrus.Errorf("failed to delete the snapshot of %s: %v", write.ref, err)
+			metricSnapshotsFailed.Add(1)
+		}
+		return
+	}
+
+	if r.hashes[write.ref] == write.snapshot.Hash {
+		metricSnapshotsUnchanged.Add(1)
+		return
+	}
+	if err := r.store.Put(ctx, write.snapshot); err != nil {
+		logrus.Errorf("failed to record the snapshot of %s: %v", write.ref, err)
+		metricSnapshotsFailed.Add(1)
+		delete(r.hashes, write.ref)
+		return
+	}
+	if len(r.hashes) >= r.maxHashes {
+		r.hashes = make(map[reconcile.ResourceRef]string)
+	}
+	r.hashes[write.ref] = write.snapshot.Hash
+	metricSnapshotsRecorded.Add(1)
+}
+
+// pruneLoop prunes the store at the given interval until the recorder is closed.
+func (r *snapshotRecorder) pruneLoop(interval time.Duration) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			pruned, err := r.store.Prune(ctx)
+			cancel()
+			metricSnapshotsPruned.Add(int64(pruned))
+			if err != nil {
+				logrus.Errorf("failed to prune snapshots: %v", err)
+			} else if pruned > 0 {
+				logrus.Infof("pruned %d snapshots beyond the retention limits", pruned)
+			}
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+// Close writes the queued snapshots and stops the recorder.
+func (r *snapshotRecorder) Close() {
+	if r == nil {
+		return
+	}
+	r.closeOnce.Do(func() { close(r.stopCh) })
+	r.wg.Wait()
+}
+
+// requestRef returns the reference to the resource of an admission request.
+func requestRef(req *admissionRequest) reconcile.ResourceRef {
+	return reconcile.ResourceRef{Group: req.Kind.Group, Kind: req.Kind.Kind, Namespace: req.Namespace, Name: req.Name}
+}
+
+// newSnapshot creates the snapshot of the protected fields of an object whose state its owner approved.
+func newSnapshot(req *admissionRequest, prot *protection, obj *unstructured.Unstructured, resourceOwner owner) (*reconcile.Snapshot, error) {
+	protected, excluded := prot.snapshotPaths()
+	snapshot, err := reconcile.NewSnapshot(requestRef(req), req.Kind.Version, obj.Object, protected, excluded)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.UID = obj.GetUID()
+	snapshot.ResourceVersion = obj.GetResourceVersion()
+	snapshot.Owner = resourceOwner.String()
+	snapshot.Timestamp = time.Now().UTC()
+	return snapshot, nil
+}
+
+// recordSnapshot records the state of an object as approved by its owner, unless the request is a dry run.
+func (h *heimdall) recordSnapshot(req *admissionRequest, obj *unstructured.Unstructured, resourceOwner owner) {
+	if h.snapshots == nil || req.DryRun {
+		return
+	}
+	prot := h.policies.protectionFor(req.Kind, req.Namespace, obj)
+	snapshot, err := newSnapshot(req, prot, obj, resourceOwner)
+	if err != nil {
+		logrus.Errorf("failed to take the snapshot of %s/%s: %v", req.Namespace, obj.GetName(), err)
+		metricSnapshotsFailed.Add(1)
+		return
+	}
+	h.snapshots.record(snapshot)
+}
+
+// forgetSnapshot deletes the snapshot of the resource of a request, unless the request is a dry run.
+func (h *heimdall) forgetSnapshot(req *admissionRequest) {
+	if req.DryRun {
+		return
+	}
+	h.snapshots.forget(requestRef(req))
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentPrefix = "segment-"
+	spoolSegmentSuffix = ".log"
+	spoolCursorFile    = "cursor"
+
+	// spoolRecordHeaderSize is the size of the length and CRC-32 preceding each record.
+	spoolRecordHeaderSize = 8
+	// spoolSegments is the number of segments the size limit is split into, i.e., the limit is enforced by dropping
+	// an eighth of it at a time.
+	spoolSegments = 8
+)
+
+var errSpoolFull = errors.New("reconcile spool is full")
+
+// spoolPosition is a position in the spool: a segment and an offset within it.
+type spoolPosition struct {
+	segment uint64
+	offset  int64
+}
+
+// spool is a write-ahead log of reconcile requests that could not be delivered to Kafka. Records are appended to
+// numbered segment files in a directory, which should be an emptyDir or a persistent volume so that the spool survives
+// restarts, and are read back in order. A cursor file records how far the spool has been replayed, consumed segments
+// are removed. Once the spool exceeds its size limit, the oldest segments are dropped.
+//
+// Each record is a big-endian uint32 length and a CRC-32 (IEEE) of the payload, followed by the payload.
+type spool struct {
+	dir         string
+	segmentSize int64
+	maxBytes    int64
+
+	mu sync.Mutex
+	// segments are the sequence numbers of the segment files on disk, oldest first. The last one is written to.
+	segments []uint64
+	sizes    map[uint64]int64
+	writer   *os.File
+	write    spoolPosition
+	read     spoolPosition
+}
+
+// openSpool opens the spool in the given directory, creating it if needed, and recovers its state from disk. The spool
+// keeps at most maxBytes on disk.
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:         dir,
+		segmentSize: maxBytes / spoolSegments,
+		maxBytes:    maxBytes,
+		sizes:       make(map[uint64]int64),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, spoolSegmentPrefix) || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, spoolSegmentPrefix), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if len(s.segments) == 0 {
+		s.segments = []uint64{1}
+	}
+	for _, seq := range s.segments {
+		// A crash may have left a partially written record at the end of a segment.
+		size, err := recoverSegment(s.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.sizes[seq] = size
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if s.writer, err = os.OpenFile(s.segmentPath(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, err
+	}
+	s.write = spoolPosition{segment: last, offset: s.sizes[last]}
+
+	s.read = s.loadCursor()
+	// Segments before the cursor have been replayed completely.
+	for s.segments[0] < s.read.segment {
+		s.removeSegment(s.segments[0])
+	}
+
+	if s.pendingLocked() {
+		logrus.Infof("reconcile spool in %s has undelivered requests, replaying them once Kafka is available", dir)
+	}
+	return s, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", spoolSegmentPrefix, seq, spoolSegmentSuffix))
+}
+
+// recoverSegment truncates the given segment after its last complete record, returning its resulting size.
+func recoverSegment(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		payload, err := readSpoolRecord(r)
+		if err != nil {
+			break
+		}
+		offset += spoolRecordHeaderSize + int64(len(payload))
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		logrus.Warnf("truncating reconcile spool segment %s from %d to %d bytes", path, info.Size(), offset)
+		if err := f.Truncate(offset); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+func readSpoolRecord(r io.Reader) ([]byte, error) {
+	var header [spoolRecordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// loadCursor reads the replay position, defaulting to the start of the oldest segment.
+func (s *spool) loadCursor() spoolPosition {
+	start := spoolPosition{segment: s.segments[0]}
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if err != nil {
+		return start
+	}
+	var pos spoolPosition
+	if _, err := fmt.Sscanf(string(data), "%d %d", &pos.segment, &pos.offset); err != nil {
+		logrus.Warnf("ignoring malformed reconcile spool cursor: %v", err)
+		return start
+	}
+	if size, ok := s.sizes[pos.segment]; !ok || pos.offset > size {
+		return start
+	}
+	return pos
+}
+
+func (s *spool) saveCursor() error {
+	path := filepath.Join(s.dir, spoolCursorFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.read.segment, s.read.offset)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// size returns the number of bytes the spool takes on disk.
+func (s *spool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalSize()
+}
+
+func (s *spool) totalSize() int64 {
+	var total int64
+	for _, size := range s.sizes {
+		total += size
+	}
+	return total
+}
+
+// append writes a reconcile request to the end of the spool.
+func (s *spool) append(value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recordSize := spoolRecordHeaderSize + int64(len(value))
+
+	// Make room by dropping the oldest segments, the write segment is never dropped.
+	for s.totalSize()+recordSize > s.maxBytes && len(s.segments) > 1 {
+		s.dropOldestSegment()
+	}
+	if s.totalSize()+recordSize > s.maxBytes {
+		return errSpoolFull
+	}
+
+	if s.write.offset > 0 && s.write.offset+recordSize > s.segmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(value)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(value))
+	copy(record[spoolRecordHeaderSize:], value)
+	if _, err := s.writer.Write(record); err != nil {
+		return err
+	}
+	if err := s.writer.Sync(); err != nil {
+		return err
+	}
+	s.write.offset += recordSize
+	s.sizes[s.write.segment] = s.write.offset
+	metricSpoolAppended.Add(1)
+	return nil
+}
+
+func (s *spool) roll() error {
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+	next := s.write.segment + 1
+	writer, err := os.OpenFile(s.segmentPath(next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.writer = writer
+	s.write = spoolPosition{segment: next}
+	s.segments = append(s.segments, next)
+	s.sizes[next] = 0
+	return nil
+}
+
+func (s *spool) dropOldestSegment() {
+	oldest := s.segments[0]
+	logrus.Warnf("reconcile spool exceeds %d bytes, dropping its oldest segment", s.maxBytes)
+	metricSpoolDropped.Add(1)
+	s.removeSegment(oldest)
+	if s.read.segment == oldest {
+		s.read = spoolPosition{segment: s.segments[0]}
+		if err := s.saveCursor(); err != nil {
+			logrus.Errorf("failed to save reconcile spool cursor: %v", err)
+		}
+	}
+}
+
+func (s *spool) removeSegment(seq uint64) {
+	if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("failed to remove reconcile spool segment: %v", err)
+	}
+	delete(s.sizes, seq)
+	s.segments = s.segments[1:]
+}
+
+// pending checks if there are spooled reconcile requests that have not been replayed yet.
+func (s *spool) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pendingLocked()
+}
+
+func (s *spool) pendingLocked() bool {
+	return s.read.segment < s.write.segment || s.read.offset < s.write.offset
+}
+
+// peek returns the oldest reconcile request that has not been replayed yet, along with the position after it to be
+// passed to commit once it has been delivered. The second return value is false if the spool is empty.
+func (s *spool) peek() ([]byte, spoolPosition, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.pendingLocked() {
+		if s.read.offset >= s.sizes[s.read.segment] {
+			// The read segment is exhausted, continue with the next one.
+			s.read = spoolPosition{segment: s.segments[1]}
+			s.removeSegment(s.segments[0])
+			if err := s.saveCursor(); err != nil {
+				return nil, spoolPosition{}, false, err
+			}
+			continue
+		}
+
+		payload, err := s.readAt(s.read)
+		if err != nil {
+			logrus.Errorf("skipping unreadable remainder of reconcile spool segment %d: %v", s.read.segment, err)
+			s.read.offset = s.sizes[s.read.segment]
+			continue
+		}
+		next := spoolPosition{segment: s.read.segment, offset: s.read.offset + spoolRecordHeaderSize + int64(len(payload))}
+		return payload, next, true, nil
+	}
+	return nil, spoolPosition{}, false, nil
+}
+
+func (s *spool) readAt(pos spoolPosition) ([]byte, error) {
+	f, err := os.Open(s.segmentPath(pos.segment))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return readSpoolRecord(f)
+}
+
+// commit marks the reconcile requests before the given position as replayed.
+func (s *spool) commit(next spoolPosition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if next.segment != s.read.segment || next.offset <= s.read.offset {
+		// The segment was dropped in the meantime.
+		return nil
+	}
+	s.read = next
+	metricSpoolReplayed.Add(1)
+	return s.saveCursor()
+}
+
+// Close closes the segment being written.
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.Close()
+}
+
+// prioritySpool splits the spool by priority, so that it is replayed highest priority first. Each priority has its
+// own spool in a subdirectory, which gets an even share of the size limit.
+type prioritySpool struct {
+	tiers map[priority.Priority]*spool
+}
+
+// prioritySpoolPosition is the position after a record in one of the spools of a prioritySpool.
+type prioritySpoolPosition struct {
+	spool *spool
+	next  spoolPosition
+}
+
+// openPrioritySpool opens the spools of all priorities in the given directory, which keep at most maxBytes on disk
+// in total.
+func openPrioritySpool(dir string, maxBytes int64) (*prioritySpool, error) {
+	ps := &prioritySpool{tiers: make(map[priority.Priority]*spool)}
+	for _, p := range priority.All {
+		tier, err := openSpool(filepath.Join(dir, string(p)), maxBytes/int64(len(priority.All)))
+		if err != nil {
+			_ = ps.Close()
+			return nil, err
+		}
+		ps.tiers[p] = tier
+	}
+
+	expvar.Publish("heimdall_spool_bytes", expvar.Func(func() interface{} {
+		var total int64
+		for _, s := range ps.spools() {
+			total += s.size()
+		}
+		return total
+	}))
+	return ps, nil
+}
+
+// spools returns the open spools in replay order.
+func (ps *prioritySpool) spools() []*spool {
+	var spools []*spool
+	for _, p := range priority.All {
+		if tier, ok := ps.tiers[p]; ok {
+			spools = append(spools, tier)
+		}
+	}
+	return spools
+}
+
+// append writes a reconcile request of the given priority to its spool.
+func (ps *prioritySpool) append(p priority.Priority, value []byte) error {
+	tier, ok := ps.tiers[p]
+	if !ok {
+		return fmt.Errorf("no reconcile spool for priority %q", p)
+	}
+	return tier.append(value)
+}
+
+// pending checks if requests of the given priority have not been replayed yet. New requests of the priority have to be
+// spooled behind them.
+func (ps *prioritySpool) pending(p priority.Priority) bool {
+	tier, ok := ps.tiers[p]
+	return ok && tier.pending()
+}
+
+// peek returns the oldest reconcile request of the highest priority that has not been replayed yet, see spool.peek.
+func (ps *prioritySpool) peek() ([]byte, prioritySpoolPosition, bool, error) {
+	for _, s := range ps.spools() {
+		record, next, ok, err := s.peek()
+		if err != nil {
+			return nil, prioritySpoolPosition{}, false, err
+		}
+		if ok {
+			return record, prioritySpoolPosition{spool: s, next: next}, true, nil
+		}
+	}
+	return nil, prioritySpoolPosition{}, false, nil
+}
+
+// commit marks the reconcile requests before the given position as replayed.
+func (ps *prioritySpool) commit(pos prioritySpoolPosition) error {
+	return pos.spool.commit(pos.next)
+}
+
+// Close closes all spools.
+func (ps *prioritySpool) Close() error {
+	var err error
+	for _, s := range ps.spools() {
+		if closeErr := s.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
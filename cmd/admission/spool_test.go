@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testSpoolMaxBytes gives test spools segments of 128 bytes, which hold two records of testSpoolRecord.
+const testSpoolMaxBytes = spoolSegments * 128
+
+// testSpoolRecord returns a spooled value of 50 bytes, i.e., a record of 58 bytes.
+func testSpoolRecord(i int) []byte {
+	return []byte(fmt.Sprintf("%-50s", fmt.Sprintf("record %d", i)))
+}
+
+func openTestSpool(t *testing.T, dir string, maxBytes int64) *spool {
+	t.Helper()
+	s, err := openSpool(dir, maxBytes)
+	if err != nil {
+		t.Fatalf("openSpool failed: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func appendTestRecords(t *testing.T, s *spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.append(testSpoolRecord(i)); err != nil {
+			t.Fatalf("append of record %d failed: %v", i, err)
+		}
+	}
+}
+
+// replayTestSpool replays up to max records from the spool, committing each of them.
+func replayTestSpool(t *testing.T, s *spool, max int) [][]byte {
+	t.Helper()
+	var records [][]byte
+	for len(records) < max {
+		record, next, ok, err := s.peek()
+		if err != nil {
+			t.Fatalf("peek failed: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if err := s.commit(next); err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func testSpoolRecords(from, to int) [][]byte {
+	var records [][]byte
+	for i := from; i < to; i++ {
+		records = append(records, testSpoolRecord(i))
+	}
+	return records
+}
+
+func spoolSegmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, spoolSegmentPrefix+"*"+spoolSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestSpoolAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, testSpoolMaxBytes)
+	if s.pending() {
+		t.Fatal("new spool is pending")
+	}
+
+	appendTestRecords(t, s, 0, 5)
+	if !s.pending() {
+		t.Fatal("spool with records is not pending")
+	}
+	if got := len(spoolSegmentFiles(t, dir)); got != 3 {
+		t.Errorf("spool has %d segments, want 3", got)
+	}
+
+	// A record that is peeked but not committed is peeked again.
+	first, _, ok, err := s.peek()
+	if err != nil || !ok {
+		t.Fatalf("peek = %v, %v", ok, err)
+	}
+	if want := testSpoolRecord(0); !reflect.DeepEqual(first, want) {
+		t.Errorf("peek = %q, want %q", first, want)
+	}
+
+	if got, want := replayTestSpool(t, s, 10), testSpoolRecords(0, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	if s.pending() {
+		t.Error("replayed spool is pending")
+	}
+	// Replayed segments are removed, except for the one being written.
+	if got := len(spoolSegmentFiles(t, dir)); got != 1 {
+		t.Errorf("replayed spool has %d segments, want 1", got)
+	}
+
+	// Records appended after the replay are replayed as well.
+	appendTestRecords(t, s, 5, 6)
+	if got, want := replayTestSpool(t, s, 10), testSpoolRecords(5, 6); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolCursorSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, testSpoolMaxBytes)
+	appendTestRecords(t, s, 0, 5)
+	if got, want := replayTestSpool(t, s, 3), testSpoolRecords(0, 3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %q, want %q", got, want)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestSpool(t, dir, testSpoolMaxBytes)
+	if !s.pending() {
+		t.Fatal("reopened spool is not pending")
+	}
+	appendTestRecords(t, s, 5, 6)
+	if got, want := replayTestSpool(t, s, 10), testSpoolRecords(3, 6); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q after reopening, want %q", got, want)
+	}
+}
+
+func TestSpoolRecoversCorruptTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// corrupt damages the given segment, which holds two complete records.
+		corrupt func(t *testing.T, path string)
+		want    [][]byte
+	}{
+		{
+			name: "torn header",
+			corrupt: func(t *testing.T, path string) {
+				appendToFile(t, path, []byte{0, 0, 0})
+			},
+			want: testSpoolRecords(0, 2),
+		},
+		{
+			name: "torn payload",
+			corrupt: func(t *testing.T, path string) {
+				appendToFile(t, path, []byte{0, 0, 0, 50, 1, 2, 3, 4, 'p', 'a', 'r', 't'})
+			},
+			want: testSpoolRecords(0, 2),
+		},
+		{
+			name: "checksum mismatch",
+			corrupt: func(t *testing.T, path string) {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[len(data)-1] ^= 0xff
+				if err := os.WriteFile(path, data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: testSpoolRecords(0, 1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestSpool(t, dir, testSpoolMaxBytes)
+			appendTestRecords(t, s, 0, 2)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			segments := spoolSegmentFiles(t, dir)
+			if len(segments) != 1 {
+				t.Fatalf("spool has %d segments, want 1", len(segments))
+			}
+			tt.corrupt(t, segments[0])
+
+			s = openTestSpool(t, dir, testSpoolMaxBytes)
+			info, err := os.Stat(segments[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(len(tt.want)) * (spoolRecordHeaderSize + 50); info.Size() != want {
+				t.Errorf("recovered segment has %d bytes, want %d", info.Size(), want)
+			}
+
+			// Records appended after the recovery follow the intact ones.
+			appendTestRecords(t, s, 2, 3)
+			want := append(tt.want, testSpoolRecord(2))
+			if got := replayTestSpool(t, s, 10); !reflect.DeepEqual(got, want) {
+				t.Errorf("replayed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func appendToFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolEvictsOldestSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, testSpoolMaxBytes)
+	// Eight segments of two records fill the spool, every further segment drops the oldest one.
+	appendTestRecords(t, s, 0, 20)
+	if size := s.size(); size > testSpoolMaxBytes {
+		t.Errorf("spool has %d bytes, want at most %d", size, testSpoolMaxBytes)
+	}
+	if got := len(spoolSegmentFiles(t, dir)); got != spoolSegments {
+		t.Errorf("spool has %d segments, want %d", got, spoolSegments)
+	}
+	// The records of the two dropped segments are lost, the others are replayed in order.
+	if got, want := replayTestSpool(t, s, 100), testSpoolRecords(4, 20); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolEvictsPartiallyReplayedSegment(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, testSpoolMaxBytes)
+	appendTestRecords(t, s, 0, 16)
+	// The cursor is in the middle of the oldest segment when it is dropped.
+	if got, want := replayTestSpool(t, s, 1), testSpoolRecords(0, 1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %q, want %q", got, want)
+	}
+	appendTestRecords(t, s, 16, 18)
+	if got, want := replayTestSpool(t, s, 100), testSpoolRecords(2, 18); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolRejectsRecordsBeyondMaxBytes(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), testSpoolMaxBytes)
+	if err := s.append(make([]byte, testSpoolMaxBytes)); err != errSpoolFull {
+		t.Errorf("append of an oversized record = %v, want %v", err, errSpoolFull)
+	}
+	appendTestRecords(t, s, 0, 1)
+	if got, want := replayTestSpool(t, s, 10), testSpoolRecords(0, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
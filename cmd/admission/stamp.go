@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/jsonpointer"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sort"
+	"strings"
+)
+
+// shouldStampOwner checks if a newly created resource is to be stamped with its creator as owner, i.e., if it was
+// created in an auto-owner namespace or by an auto-owner principal.
+func (h *heimdall) shouldStampOwner(req *admissionRequest, obj *unstructured.Unstructured) bool {
+	if _, managed, _ := ownerOf(obj); managed {
+		return false
+	}
+	// Dependents created by controllers (e.g. the pods of a ReplicaSet) inherit their labels from the parent's
+	// template, stamping them would make the controller their owner.
+	if len(obj.GetOwnerReferences()) > 0 {
+		return false
+	}
+	if h.config.autoOwnerNamespaces[req.Namespace] {
+		return true
+	}
+	for _, principal := range h.config.autoOwnerPrincipals {
+		if principal.matches(req.UserInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// stampOwner returns the patch operations that make the requesting user the owner of the newly created resource, and
+// set its priority if configured, along with the resource as patched.
+func (h *heimdall) stampOwner(req *admissionRequest, obj *unstructured.Unstructured) ([]patchOperation, *unstructured.Unstructured) {
+	creator := ownerForUser(req.UserInfo)
+
+	labels := make(map[string]string)
+	annotations := make(map[string]string)
+	if v, ok := creator.labelValue(); ok {
+		labels[ownerLabel] = v
+	} else {
+		// The label only marks the resource as owned, the annotation carries the identity.
+		labels[ownerLabel] = sanitizeLabelValue(creator.name)
+		annotations[ownerAnnotation] = creator.String()
+	}
+	if h.config.autoOwnerPriority != "" && obj.GetLabels()[priorityLabel] == "" {
+		labels[priorityLabel] = string(h.config.autoOwnerPriority)
+	}
+
+	logrus.Infof("stamping %s/%s with owner %s", req.Namespace, obj.GetName(), creator)
+
+	patchOps := addMetadataEntries("labels", obj.GetLabels(), labels)
+	patchOps = append(patchOps, addMetadataEntries("annotations", obj.GetAnnotations(), annotations)...)
+
+	stampedObj := obj.DeepCopy()
+	stampedObj.SetLabels(mergeMetadataEntries(obj.GetLabels(), labels))
+	if len(annotations) > 0 {
+		stampedObj.SetAnnotations(mergeMetadataEntries(obj.GetAnnotations(), annotations))
+	}
+	return patchOps, stampedObj
+}
+
+// mergeMetadataEntries returns the existing labels or annotations of an object with the given entries added.
+func mergeMetadataEntries(existing, entries map[string]string) map[string]string {
+	merged := make(map[string]string, len(existing)+len(entries))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range entries {
+		merged[k] = v
+	}
+	return merged
+}
+
+// addMetadataEntries returns the patch operations adding the given entries to the labels or annotations (field) of an
+// object, given their existing values.
+func addMetadataEntries(field string, existing, entries map[string]string) []patchOperation {
+	if len(entries) == 0 {
+		return nil
+	}
+	if existing == nil {
+		return []patchOperation{{Op: "add", Path: "/metadata/" + field, Value: entries}}
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var patchOps []patchOperation
+	for _, k := range keys {
+		patchOps = append(patchOps, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/" + field + "/" + jsonpointer.Escape(k),
+			Value: entries[k],
+		})
+	}
+	return patchOps
+}
+
+// sanitizeLabelValue turns an arbitrary string into a valid label value by replacing disallowed characters.
+func sanitizeLabelValue(s string) string {
+	v := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '-'
+	}, s)
+	if len(v) > validation.LabelValueMaxLength {
+		v = v[:validation.LabelValueMaxLength]
+	}
+	v = strings.Trim(v, "-_.")
+	if v == "" {
+		return "owned"
+	}
+	return v
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kafka "github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topic configs managed by Heimdall, see https://kafka.apache.org/documentation/#topicconfigs.
+const (
+	topicRetentionMs       = "retention.ms"
+	topicCleanupPolicy     = "cleanup.policy"
+	topicMinInSyncReplicas = "min.insync.replicas"
+)
+
+const (
+	// strimziClusterLabel assigns a KafkaTopic resource to its Kafka cluster.
+	strimziClusterLabel = "strimzi.io/cluster"
+	// kafkaTopicRequestTimeout bounds getting and creating the KafkaTopic resource.
+	kafkaTopicRequestTimeout = 10 * time.Second
+	// kafkaTopicReadyTimeout bounds waiting for the topic operator to create the topic.
+	kafkaTopicReadyTimeout = 30 * time.Second
+	// topicVerifyInterval is how often the topics are verified while the producer stays connected to the same brokers
+	// with the same credentials. They are always verified before connecting.
+	topicVerifyInterval = 10 * time.Minute
+)
+
+// kafkaTopicGVR is the Strimzi KafkaTopic custom resource, which the Strimzi topic operator reconciles into a topic.
+var kafkaTopicGVR = schema.GroupVersionResource{Group: "kafka.strimzi.io", Version: "v1beta2", Resource: "kafkatopics"}
+
+// topicProvisioning determines how the Heimdall topic is provisioned.
+type topicProvisioning string
+
+const (
+	// topicProvisioningAdmin creates the topic with the Kafka admin API.
+	topicProvisioningAdmin topicProvisioning = "admin"
+	// topicProvisioningStrimzi creates a Strimzi KafkaTopic resource and waits for it to become ready.
+	topicProvisioningStrimzi topicProvisioning = "strimzi"
+	// topicProvisioningNone assumes the topic is provisioned out of band.
+	topicProvisioningNone topicProvisioning = "none"
+)
+
+func parseTopicProvisioning(s string) (topicProvisioning, error) {
+	switch p := topicProvisioning(s); p {
+	case topicProvisioningAdmin, topicProvisioningStrimzi, topicProvisioningNone:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid topic provisioning %q, must be one of %s, %s or %s", s,
+		topicProvisioningAdmin, topicProvisioningStrimzi, topicProvisioningNone)
+}
+
+// parseCleanupPolicy validates a cleanup.policy topic config.
+func parseCleanupPolicy(s string) (string, error) {
+	switch s {
+	case "delete", "compact", "compact,delete", "delete,compact":
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid cleanup policy %q, must be one of delete, compact or compact,delete", s)
+}
+
+// topicSettings are the desired settings of the Heimdall topic.
+type topicSettings struct {
+	partitions        int
+	replicationFactor int
+	retention         time.Duration
+	cleanupPolicy     string
+	minInSyncReplicas int
+}
+
+// configs returns the topic configs of the settings, by name.
+func (s topicSettings) configs() map[string]string {
+	return map[string]string{
+		topicRetentionMs:       strconv.FormatInt(s.retention.Milliseconds(), 10),
+		topicCleanupPolicy:     s.cleanupPolicy,
+		topicMinInSyncReplicas: strconv.Itoa(s.minInSyncReplicas),
+	}
+}
+
+// expected returns the settings by the names that topicMismatch reports them as.
+func (s topicSettings) expected() map[string]string {
+	expected := s.configs()
+	expected["partitions"] = strconv.Itoa(s.partitions)
+	expected["replication factor"] = strconv.Itoa(s.replicationFactor)
+	return expected
+}
+
+// topicMismatchError reports an existing topic whose settings differ from the configured ones. It is not retried,
+// the configuration or the topic has to be fixed.
+type topicMismatchError struct {
+	topic       string
+	differences []string
+}
+
+func (e *topicMismatchError) Error() string {
+	return fmt.Sprintf("existing Kafka topic %s does not match the configuration: %s", e.topic,
+		strings.Join(e.differences, ", "))
+}
+
+// topicMismatch returns a topicMismatchError if the given actual settings differ from the expected ones.
+func topicMismatch(topic string, expected, actual map[string]string) error {
+	var differences []string
+	for name, want := range expected {
+		if got := actual[name]; got != want {
+			differences = append(differences, fmt.Sprintf("%s is %q instead of %q", name, got, want))
+		}
+	}
+	if len(differences) == 0 {
+		return nil
+	}
+	sort.Strings(differences)
+	return &topicMismatchError{topic: topic, differences: differences}
+}
+
+// topicProvisioner makes sure the Heimdall topic, or the topics per priority, exist with the configured settings
+// before the producer connects, and that they keep them while it is connected.
+type topicProvisioner struct {
+	provisioning topicProvisioning
+	topics       []string
+	settings     topicSettings
+	namespace    string
+	cluster      string
+	client       dynamic.Interface
+
+	// mu serializes provisioning, so that a topic is not created twice. It guards the admin client.
+	mu sync.Mutex
+	// admin is the admin client of the last provisioning, which is reused as long as the brokers and the TLS and SASL
+	// material it was connected with stay the same.
+	admin            kafka.ClusterAdmin
+	adminBrokers     []string
+	adminFingerprint string
+}
+
+func newTopicProvisioner(cfg *config, client dynamic.Interface) *topicProvisioner {
+	p := &topicProvisioner{
+		provisioning: cfg.kafkaTopicProvisioning,
+		topics:       []string{priority.Topic},
+		settings:     cfg.kafkaTopic,
+		namespace:    cfg.kafka.Namespace,
+		cluster:      cfg.kafka.Cluster,
+		client:       client,
+	}
+	if cfg.kafkaPriorityTopics {
+		p.topics = nil
+		for _, prio := range priority.All {
+			p.topics = append(p.topics, prio.Topic())
+		}
+	}
+	return p
+}
+
+// ensure provisions the topics that do not exist and verifies the settings of those that do, using the given brokers
+// and client configuration, whose TLS and SASL material is identified by fingerprint, with the admin API. It returns
+// a *topicMismatchError if a topic exists with different settings.
+func (p *topicProvisioner) ensure(brokers []string, config *kafka.Config, fingerprint string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.provisioning {
+	case topicProvisioningAdmin:
+		admin, err := p.adminClient(brokers, config, fingerprint)
+		if err != nil {
+			return err
+		}
+		for _, topic := range p.topics {
+			if err := p.ensureWithAdmin(admin, topic); err != nil {
+				var mismatch *topicMismatchError
+				if !errors.As(err, &mismatch) {
+					// The connection may be broken, connect again next time.
+					p.closeAdmin()
+				}
+				return err
+			}
+		}
+	case topicProvisioningStrimzi:
+		for _, topic := range p.topics {
+			if err := p.ensureWithStrimzi(topic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adminClient returns the admin client for the given brokers and client configuration, reusing the previous one if
+// they and the TLS and SASL material did not change. p.mu must be held.
+func (p *topicProvisioner) adminClient(brokers []string, config *kafka.Config, fingerprint string) (kafka.ClusterAdmin, error) {
+	if p.admin != nil && reflect.DeepEqual(brokers, p.adminBrokers) && fingerprint == p.adminFingerprint {
+		return p.admin, nil
+	}
+	p.closeAdmin()
+	admin, err := kafka.NewClusterAdmin(brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka: %v", err)
+	}
+	p.admin, p.adminBrokers, p.adminFingerprint = admin, brokers, fingerprint
+	return admin, nil
+}
+
+// closeAdmin closes the admin client, if any. p.mu must be held.
+func (p *topicProvisioner) closeAdmin() {
+	if p.admin != nil {
+		_ = p.admin.Close()
+		p.admin, p.adminBrokers, p.adminFingerprint = nil, nil, ""
+	}
+}
+
+// Close closes the admin client.
+func (p *topicProvisioner) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeAdmin()
+}
+
+func (p *topicProvisioner) ensureWithAdmin(admin kafka.ClusterAdmin, topic string) error {
+	metadata, err := admin.DescribeTopics([]string{topic})
+	if err != nil {
+		return fmt.Errorf("failed to describe Kafka topic %s: %v", topic, err)
+	}
+	if len(metadata) == 1 && metadata[0].Err == kafka.ErrNoError {
+		return p.verifyWithAdmin(admin, topic, metadata[0])
+	}
+	if len(metadata) == 1 && metadata[0].Err != kafka.ErrUnknownTopicOrPartition {
+		return fmt.Errorf("failed to describe Kafka topic %s: %v", topic, metadata[0].Err)
+	}
+
+	configEntries := make(map[string]*string)
+	for name, value := range p.settings.configs() {
+		value := value
+		configEntries[name] = &value
+	}
+	err = admin.CreateTopic(topic, &kafka.TopicDetail{
+		NumPartitions:     int32(p.settings.partitions),
+		ReplicationFactor: int16(p.settings.replicationFactor),
+		ConfigEntries:     configEntries,
+	}, false)
+	var topicErr *kafka.TopicError
+	if errors.As(err, &topicErr) && topicErr.Err == kafka.ErrTopicAlreadyExists {
+		// Created concurrently, e.g. by another replica.
+		if metadata, err = admin.DescribeTopics([]string{topic}); err != nil {
+			return fmt.Errorf("failed to describe Kafka topic %s: %v", topic, err)
+		}
+		return p.verifyWithAdmin(admin, topic, metadata[0])
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka topic %s: %v", topic, err)
+	}
+	logrus.Infof("created Kafka topic %s with %d partitions and replication factor %d", topic,
+		p.settings.partitions, p.settings.replicationFactor)
+	return nil
+}
+
+func (p *topicProvisioner) verifyWithAdmin(admin kafka.ClusterAdmin, topic string, metadata *kafka.TopicMetadata) error {
+	replicationFactor := 0
+	if len(metadata.Partitions) > 0 {
+		replicationFactor = len(metadata.Partitions[0].Replicas)
+	}
+	actual := map[string]string{
+		"partitions":         strconv.Itoa(len(metadata.Partitions)),
+		"replication factor": strconv.Itoa(replicationFactor),
+	}
+
+	configs := p.settings.configs()
+	resource := kafka.ConfigResource{Type: kafka.TopicResource, Name: topic}
+	for name := range configs {
+		resource.ConfigNames = append(resource.ConfigNames, name)
+	}
+	entries, err := admin.DescribeConfig(resource)
+	if err != nil {
+		return fmt.Errorf("failed to describe the configs of Kafka topic %s: %v", topic, err)
+	}
+	for _, entry := range entries {
+		actual[entry.Name] = entry.Value
+	}
+	return topicMismatch(topic, p.settings.expected(), actual)
+}
+
+// ensureWithStrimzi creates the KafkaTopic resource of the given topic, or verifies the existing one, and waits for
+// the topic operator to report it ready.
+func (p *topicProvisioner) ensureWithStrimzi(name string) error {
+	topics := p.client.Resource(kafkaTopicGVR).Namespace(p.namespace)
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaTopicRequestTimeout)
+	defer cancel()
+
+	topic, err := topics.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		topic, err = topics.Create(ctx, p.kafkaTopic(name), metav1.CreateOptions{})
+		if err == nil {
+			logrus.Infof("created KafkaTopic %s/%s", p.namespace, name)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to provision KafkaTopic %s/%s: %v", p.namespace, name, err)
+	}
+	if err := p.verifyKafkaTopic(topic); err != nil {
+		return err
+	}
+
+	err = wait.PollUntilContextTimeout(context.Background(), time.Second, kafkaTopicReadyTimeout, true, func(ctx context.Context) (bool, error) {
+		topic, err := topics.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return kafkaTopicReady(topic), nil
+	})
+	if err != nil {
+		return fmt.Errorf("KafkaTopic %s/%s not ready after %s", p.namespace, name, kafkaTopicReadyTimeout)
+	}
+	return nil
+}
+
+// kafkaTopic returns the KafkaTopic resource for the given topic with the configured settings.
+func (p *topicProvisioner) kafkaTopic(name string) *unstructured.Unstructured {
+	configs := make(map[string]interface{})
+	for name, value := range p.settings.configs() {
+		configs[name] = value
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": kafkaTopicGVR.GroupVersion().String(),
+		"kind":       "KafkaTopic",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": p.namespace,
+			"labels":    map[string]interface{}{strimziClusterLabel: p.cluster},
+		},
+		"spec": map[string]interface{}{
+			"topicName":  name,
+			"partitions": int64(p.settings.partitions),
+			"replicas":   int64(p.settings.replicationFactor),
+			"config":     configs,
+		},
+	}}
+}
+
+// verifyKafkaTopic compares the spec of an existing KafkaTopic resource with the configured settings.
+func (p *topicProvisioner) verifyKafkaTopic(topic *unstructured.Unstructured) error {
+	spec, _, _ := unstructured.NestedMap(topic.Object, "spec")
+	configs, _, _ := unstructured.NestedMap(spec, "config")
+	actual := map[string]string{
+		"partitions":         fmt.Sprint(spec["partitions"]),
+		"replication factor": fmt.Sprint(spec["replicas"]),
+	}
+	for name := range p.settings.configs() {
+		if value, ok := configs[name]; ok {
+			actual[name] = fmt.Sprint(value)
+		}
+	}
+	return topicMismatch(topic.GetName(), p.settings.expected(), actual)
+}
+
+// kafkaTopicReady returns whether the topic operator reconciled the current generation of the KafkaTopic resource.
+func kafkaTopicReady(topic *unstructured.Unstructured) bool {
+	observedGeneration, _, _ := unstructured.NestedInt64(topic.Object, "status", "observedGeneration")
+	if observedGeneration < topic.GetGeneration() {
+		return false
+	}
+	conditions, _, _ := unstructured.NestedSlice(topic.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == "Ready" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
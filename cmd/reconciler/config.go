@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/env"
+	"github.com/stackrox/admission-controller-heimdall/internal/kafkaclient"
+	"github.com/stackrox/admission-controller-heimdall/internal/priority"
+	"time"
+)
+
+// config holds the runtime configuration of the reconciler. It is read from environment variables, which are set in
+// deployment/reconciler.yaml.
+type config struct {
+	// kafka holds the settings for connecting to Kafka, shared with the admission controller.
+	kafka kafkaclient.Config
+
+	// topics are the topics reconcile requests are consumed from. If existingTopicsOnly is set, only those of them
+	// that exist are consumed, which is the case for the default topics.
+	topics             []string
+	existingTopicsOnly bool
+	// group is the Kafka consumer group the reconcilers share.
+	group string
+	// deadLetterTopic receives the reconcile requests that could not be processed.
+	deadLetterTopic string
+	// retryMax is how often processing a reconcile request is retried before it is sent to the dead-letter topic.
+	retryMax int
+	// retryBackoff is the wait before the first retry, doubling with each further retry.
+	retryBackoff time.Duration
+
+	// snapshotStore is the backend holding the snapshots of owner-approved state: configmap, secret or file, with the
+	// namespace of the ConfigMaps or Secrets and the directory of the files.
+	snapshotStore     string
+	snapshotNamespace string
+	snapshotDir       string
+	// snapshotMaxAge is the age beyond which snapshots are not restored, zero for no limit.
+	snapshotMaxAge time.Duration
+
+	// metricsAddr is the address the metrics are served on over plain HTTP.
+	metricsAddr string
+}
+
+// loadConfig reads the configuration from the environment, applying defaults for unset variables.
+func loadConfig() (*config, error) {
+	cfg := &config{}
+	var err error
+
+	if cfg.kafka, err = kafkaclient.LoadConfig(); err != nil {
+		return nil, err
+	}
+
+	if cfg.topics = env.List("HEIMDALL_RECONCILER_TOPICS", nil); len(cfg.topics) == 0 {
+		// The topics the admission controller publishes to: the Heimdall topic, or the topics per priority with
+		// HEIMDALL_KAFKA_PRIORITY_TOPICS.
+		cfg.topics, cfg.existingTopicsOnly = priority.Topics(), true
+	}
+	cfg.group = env.String("HEIMDALL_RECONCILER_GROUP", "heimdall-reconciler")
+	cfg.deadLetterTopic = env.String("HEIMDALL_RECONCILER_DEAD_LETTER_TOPIC", "heimdall-topic-dead-letter")
+	if cfg.retryMax, err = env.NonNegativeInt("HEIMDALL_RECONCILER_RETRY_MAX", 5); err != nil {
+		return nil, err
+	}
+	if cfg.retryBackoff, err = env.Duration("HEIMDALL_RECONCILER_RETRY_BACKOFF", time.Second); err != nil {
+		return nil, err
+	}
+
+	switch cfg.snapshotStore = env.String("HEIMDALL_SNAPSHOT_STORE", "configmap"); cfg.snapshotStore {
+	case "configmap", "secret", "file":
+	default:
+		return nil, fmt.Errorf("invalid value for HEIMDALL_SNAPSHOT_STORE: invalid snapshot store %q, must be one of configmap, secret or file", cfg.snapshotStore)
+	}
+	cfg.snapshotNamespace = env.String("HEIMDALL_SNAPSHOT_NAMESPACE", "heimdall")
+	cfg.snapshotDir = env.String("HEIMDALL_SNAPSHOT_DIR", "/var/lib/heimdall/snapshots")
+	if cfg.snapshotMaxAge, err = env.Duration("HEIMDALL_SNAPSHOT_MAX_AGE", 30*24*time.Hour); err != nil {
+		return nil, err
+	}
+	cfg.metricsAddr = env.String("HEIMDALL_METRICS_ADDR", ":8080")
+
+	return cfg, nil
+}
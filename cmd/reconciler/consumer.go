@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	kafka "github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/message"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"sync"
+	"time"
+)
+
+// errorHeader carries the reason a reconcile request was sent to the dead-letter topic.
+const errorHeader = "heimdall-reconcile-error"
+
+// eventRestorer restores the resource of a reconcile event, see restorer.
+type eventRestorer interface {
+	restore(ctx context.Context, event *reconcile.Event) error
+}
+
+// consumer handles the reconcile requests of the claimed partitions. It implements kafka.ConsumerGroupHandler.
+type consumer struct {
+	restorer eventRestorer
+	producer kafka.SyncProducer
+	cfg      *config
+	locks    *keyedMutex
+}
+
+func (c *consumer) Setup(kafka.ConsumerGroupSession) error {
+	return nil
+}
+
+func (c *consumer) Cleanup(kafka.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim handles the messages of a partition in order. A message is marked as consumed once it was processed or
+// sent to the dead-letter topic, so that it is redelivered if the reconciler stops or loses the partition before.
+func (c *consumer) ConsumeClaim(session kafka.ConsumerGroupSession, claim kafka.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		if !c.handle(session.Context(), msg) {
+			return nil
+		}
+		session.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+// handle processes a reconcile request, retrying failures with exponential backoff and sending the request to the
+// dead-letter topic if they persist. It returns false if it was interrupted by the end of the session.
+func (c *consumer) handle(ctx context.Context, msg *kafka.ConsumerMessage) bool {
+	event, err := decodeEvent(msg)
+	if err != nil {
+		logrus.Errorf("ERROR: invalid reconcile request at %s/%d@%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+		return c.deadLetter(msg, err)
+	}
+	ref := reconcile.RefOf(event)
+
+	// Requests for the same resource may arrive on different partitions, e.g. when the producer's message key or the
+	// number of partitions changes, so they are serialized across claims.
+	unlock := c.locks.lock(ref.String())
+	defer unlock()
+
+	backoff := c.cfg.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err = c.restorer.restore(ctx, event)
+		if err == nil {
+			return true
+		}
+		if isPermanent(err) || attempt > c.cfg.retryMax {
+			break
+		}
+		logrus.Warnf("failed to reconcile %s (attempt %d), retrying in %s: %v", ref, attempt, backoff, err)
+		metricRetries.Add(1)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	logrus.Errorf("ERROR: failed to reconcile %s: %v", ref, err)
+	return c.deadLetter(msg, err)
+}
+
+// deadLetter sends the given message to the dead-letter topic, with the reason in the error header. It returns false
+// if it was interrupted by the end of the session, in which case the message is redelivered to the next session.
+func (c *consumer) deadLetter(msg *kafka.ConsumerMessage, reason error) bool {
+	dead := &kafka.ProducerMessage{
+		Topic: c.cfg.deadLetterTopic,
+		Key:   kafka.ByteEncoder(msg.Key),
+		Value: kafka.ByteEncoder(msg.Value),
+	}
+	for _, header := range msg.Headers {
+		dead.Headers = append(dead.Headers, *header)
+	}
+	dead.Headers = append(dead.Headers, kafka.RecordHeader{Key: []byte(errorHeader), Value: []byte(reason.Error())})
+
+	if _, _, err := c.producer.SendMessage(dead); err != nil {
+		// Not marking the message makes it redelivered, rather than lost.
+		logrus.Errorf("ERROR: failed to send reconcile request to %s: %v", c.cfg.deadLetterTopic, err)
+		return false
+	}
+	metricDeadLettered.Add(1)
+	return true
+}
+
+// decodeEvent decodes the reconcile event of a message, in any of the encodings of the admission controller.
+func decodeEvent(msg *kafka.ConsumerMessage) (*reconcile.Event, error) {
+	headers := make([]message.Header, 0, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers = append(headers, message.Header{Key: string(header.Key), Value: string(header.Value)})
+	}
+	return message.Decode(headers, msg.Value)
+}
+
+// keyedMutex provides a mutex per key, which is released once no one holds or waits for it.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// lock locks the mutex of the given key, and returns the function unlocking it.
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
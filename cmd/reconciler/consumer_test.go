@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	kafka "github.com/Shopify/sarama"
+	"github.com/google/uuid"
+	"github.com/stackrox/admission-controller-heimdall/internal/message"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testEvent = `{"MessageID":"3f0c2a6e-5b8f-4c1e-9a57-0d2f3b4c5d6e","Name":"web","Namespace":"team-a","Kind":"Deployment",` +
+	`"Group":"apps","Version":"v1","Operation":"UPDATE","SchemaVersion":1}`
+
+func TestDecodeEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		value   string
+		want    *reconcile.Event
+		wantErr bool
+	}{
+		{
+			name:  "json",
+			value: testEvent,
+		},
+		{
+			name: "cloudevents binary",
+			headers: map[string]string{
+				"ce_specversion": "1.0",
+				"ce_type":        "io.heimdall.reconcile.apps.v1.Deployment",
+				"content-type":   "application/json",
+			},
+			value: testEvent,
+		},
+		{
+			name:    "cloudevents structured",
+			headers: map[string]string{"content-type": "application/cloudevents+json"},
+			value: `{"specversion":"1.0","type":"io.heimdall.reconcile.apps.v1.Deployment",` +
+				`"datacontenttype":"application/json","data":` + testEvent + `}`,
+		},
+		{
+			name:  "unversioned event",
+			value: `{"Name":"web","Namespace":"team-a","Kind":"Deployment","Group":"apps","Version":"v1"}`,
+			want: &reconcile.Event{
+				Name: "web", Namespace: "team-a", Kind: "Deployment", Group: "apps", Version: "v1",
+			},
+		},
+		{
+			name:    "invalid cloudevent",
+			headers: map[string]string{"content-type": "application/cloudevents+json"},
+			value:   testEvent[:20],
+			wantErr: true,
+		},
+		{
+			name:    "unsupported schema version",
+			value:   `{"Name":"web","Kind":"Deployment","SchemaVersion":99}`,
+			wantErr: true,
+		},
+		{
+			name:    "no resource",
+			value:   `{"Kind":"Deployment","SchemaVersion":1}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &kafka.ConsumerMessage{Value: []byte(tt.value)}
+			for key, value := range tt.headers {
+				msg.Headers = append(msg.Headers, &kafka.RecordHeader{Key: []byte(key), Value: []byte(value)})
+			}
+			got, err := decodeEvent(msg)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("decodeEvent = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeEvent failed: %v", err)
+			}
+			want := tt.want
+			if want == nil {
+				want = &reconcile.Event{
+					MessageID:     uuid.MustParse("3f0c2a6e-5b8f-4c1e-9a57-0d2f3b4c5d6e"),
+					Name:          "web",
+					Namespace:     "team-a",
+					Kind:          "Deployment",
+					Group:         "apps",
+					Version:       "v1",
+					Operation:     "UPDATE",
+					SchemaVersion: 1,
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decodeEvent = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// TestDecodeEncodedEvent checks that the reconciler decodes the events the admission controller encodes.
+func TestDecodeEncodedEvent(t *testing.T) {
+	want := &reconcile.Event{
+		MessageID:     uuid.MustParse("3f0c2a6e-5b8f-4c1e-9a57-0d2f3b4c5d6e"),
+		Name:          "web",
+		Namespace:     "team-a",
+		Kind:          "Deployment",
+		Group:         "apps",
+		Version:       "v1",
+		Operation:     "UPDATE",
+		SchemaVersion: reconcile.SchemaVersion,
+		User:          reconcile.User{Username: "jane"},
+		Timestamp:     time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC),
+		Reason:        "non-owner user jane cannot change protected fields: /spec/replicas",
+	}
+	for _, encoding := range []message.Encoding{
+		message.EncodingJSON, message.EncodingCloudEventsBinary, message.EncodingCloudEventsStructured,
+	} {
+		headers, value, err := message.Encode(want, encoding)
+		if err != nil {
+			t.Fatalf("encoding as %s failed: %v", encoding, err)
+		}
+		msg := &kafka.ConsumerMessage{Value: value}
+		for _, header := range headers {
+			msg.Headers = append(msg.Headers, &kafka.RecordHeader{Key: []byte(header.Key), Value: []byte(header.Value)})
+		}
+		got, err := decodeEvent(msg)
+		if err != nil {
+			t.Fatalf("decodeEvent of %s failed: %v", encoding, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("decodeEvent of %s = %+v, want %+v", encoding, got, want)
+		}
+	}
+}
+
+func TestConsumerHandle(t *testing.T) {
+	errTransient := errors.New("the object has been modified")
+	tests := []struct {
+		name  string
+		value string
+		// restoreErrs are the results of the restore attempts, the last one repeats.
+		restoreErrs []error
+		// sendErr is the result of sending to the dead-letter topic.
+		sendErr error
+		// canceled ends the session before the request is handled.
+		canceled bool
+
+		wantAttempts   int
+		wantDeadLetter string
+		wantHandled    bool
+	}{
+		{
+			name:         "restored",
+			value:        testEvent,
+			restoreErrs:  []error{nil},
+			wantAttempts: 1,
+			wantHandled:  true,
+		},
+		{
+			name:         "restored after retries",
+			value:        testEvent,
+			restoreErrs:  []error{errTransient, errTransient, nil},
+			wantAttempts: 3,
+			wantHandled:  true,
+		},
+		{
+			name:           "retries exhausted",
+			value:          testEvent,
+			restoreErrs:    []error{errTransient},
+			wantAttempts:   3,
+			wantDeadLetter: errTransient.Error(),
+			wantHandled:    true,
+		},
+		{
+			name:           "permanent error",
+			value:          testEvent,
+			restoreErrs:    []error{errTransient, permanent("no snapshot of the resource")},
+			wantAttempts:   2,
+			wantDeadLetter: "no snapshot of the resource",
+			wantHandled:    true,
+		},
+		{
+			name:           "invalid request",
+			value:          `{"Kind":"Deployment"}`,
+			wantDeadLetter: "event does not identify a resource",
+			wantHandled:    true,
+		},
+		{
+			name:           "dead-letter topic unavailable",
+			value:          testEvent,
+			restoreErrs:    []error{permanent("no snapshot of the resource")},
+			sendErr:        kafka.ErrLeaderNotAvailable,
+			wantAttempts:   1,
+			wantDeadLetter: "no snapshot of the resource",
+		},
+		{
+			name:         "session ended during backoff",
+			value:        testEvent,
+			restoreErrs:  []error{errTransient},
+			canceled:     true,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restorer := &fakeRestorer{errs: tt.restoreErrs}
+			producer := &fakeSyncProducer{err: tt.sendErr}
+			c := &consumer{
+				restorer: restorer,
+				producer: producer,
+				cfg:      &config{deadLetterTopic: "dead-letter", retryMax: 2, retryBackoff: time.Millisecond},
+				locks:    newKeyedMutex(),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.canceled {
+				c.cfg.retryBackoff = time.Hour
+				cancel()
+			}
+			msg := &kafka.ConsumerMessage{
+				Topic:   "heimdall-topic",
+				Key:     []byte("team-a/web"),
+				Value:   []byte(tt.value),
+				Headers: []*kafka.RecordHeader{{Key: []byte("heimdall-priority"), Value: []byte("high")}},
+			}
+
+			if got := c.handle(ctx, msg); got != tt.wantHandled {
+				t.Errorf("handle = %t, want %t", got, tt.wantHandled)
+			}
+			if restorer.attempts != tt.wantAttempts {
+				t.Errorf("%d restore attempts, want %d", restorer.attempts, tt.wantAttempts)
+			}
+			if tt.wantDeadLetter == "" {
+				if len(producer.sent) != 0 {
+					t.Errorf("sent %d messages to the dead-letter topic, want none", len(producer.sent))
+				}
+				return
+			}
+			if len(producer.sent) != 1 {
+				t.Fatalf("sent %d messages to the dead-letter topic, want 1", len(producer.sent))
+			}
+			dead := producer.sent[0]
+			if dead.Topic != "dead-letter" {
+				t.Errorf("dead-letter topic = %s, want dead-letter", dead.Topic)
+			}
+			if key, _ := dead.Key.Encode(); string(key) != "team-a/web" {
+				t.Errorf("dead-letter key = %s, want team-a/web", key)
+			}
+			if value, _ := dead.Value.Encode(); string(value) != tt.value {
+				t.Errorf("dead-letter value = %s, want %s", value, tt.value)
+			}
+			wantHeaders := []kafka.RecordHeader{
+				{Key: []byte("heimdall-priority"), Value: []byte("high")},
+				{Key: []byte(errorHeader), Value: []byte(tt.wantDeadLetter)},
+			}
+			if !reflect.DeepEqual(dead.Headers, wantHeaders) {
+				t.Errorf("dead-letter headers = %q, want %q", dead.Headers, wantHeaders)
+			}
+		})
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	m := newKeyedMutex()
+	unlockA := m.lock("a")
+	// Other keys are not blocked.
+	m.lock("b")()
+
+	locked, unlocked := make(chan struct{}), make(chan struct{})
+	go func() {
+		unlock := m.lock("a")
+		close(locked)
+		unlock()
+		close(unlocked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked a key that is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("failed to lock a released key")
+	}
+	<-unlocked
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.locks) != 0 {
+		t.Errorf("%d mutexes kept after all were released, want none", len(m.locks))
+	}
+}
+
+// fakeRestorer returns the configured errors from its restore attempts, repeating the last one.
+type fakeRestorer struct {
+	errs     []error
+	attempts int
+}
+
+func (r *fakeRestorer) restore(context.Context, *reconcile.Event) error {
+	r.attempts++
+	if len(r.errs) == 0 {
+		return nil
+	}
+	err := r.errs[0]
+	if len(r.errs) > 1 {
+		r.errs = r.errs[1:]
+	}
+	return err
+}
+
+// fakeSyncProducer records the messages sent with SendMessage, failing them with err if set. Its other methods are
+// not implemented.
+type fakeSyncProducer struct {
+	kafka.SyncProducer
+	err error
+
+	mu   sync.Mutex
+	sent []*kafka.ProducerMessage
+}
+
+func (p *fakeSyncProducer) SendMessage(msg *kafka.ProducerMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent)), p.err
+}
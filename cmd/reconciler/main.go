@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	kafka "github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/internal/kafkaclient"
+	"github.com/stackrox/admission-controller-heimdall/internal/metrics"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// consumeRetryBackoff is the wait before rejoining the consumer group after a session failed.
+const consumeRetryBackoff = 5 * time.Second
+
+// newKafkaConfig returns the configuration of the consumer group and the dead-letter producer.
+func newKafkaConfig(security *kafkaclient.Security) *kafka.Config {
+	config := kafka.NewConfig()
+	config.Consumer.Offsets.Initial = kafka.OffsetOldest
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = kafka.WaitForAll
+	security.Apply(config)
+	return config
+}
+
+// newSnapshotStore opens the configured snapshot store. Snapshots are pruned by the admission controller, which
+// records them, so only their maximum age applies here.
+func newSnapshotStore(cfg *config, clientset kubernetes.Interface) (reconcile.SnapshotStore, error) {
+	retention := reconcile.Retention{MaxAge: cfg.snapshotMaxAge}
+	switch cfg.snapshotStore {
+	case "secret":
+		return reconcile.NewSecretSnapshotStore(clientset, cfg.snapshotNamespace, retention), nil
+	case "file":
+		return reconcile.NewFileSnapshotStore(cfg.snapshotDir, retention)
+	}
+	return reconcile.NewConfigMapSnapshotStore(clientset, cfg.snapshotNamespace, retention), nil
+}
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		logrus.Fatalf("invalid configuration: %v", err)
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		logrus.Fatalf("failed to load in-cluster Kubernetes config: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		logrus.Fatalf("failed to create Kubernetes client: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		logrus.Fatalf("failed to create Kubernetes client: %v", err)
+	}
+	store, err := newSnapshotStore(cfg, clientset)
+	if err != nil {
+		logrus.Fatalf("failed to open the snapshot store: %v", err)
+	}
+
+	// The brokers and credentials are resolved once, a restart picks up changed ones.
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	brokers, err := kafkaclient.NewBrokerDiscovery(dynamicClient, &cfg.kafka, stopCh).Brokers()
+	if err != nil {
+		logrus.Fatalf("failed to get Kafka brokers: %v", err)
+	}
+	security, err := kafkaclient.LoadSecurity(&cfg.kafka)
+	if err != nil {
+		logrus.Fatalf("failed to load Kafka credentials: %v", err)
+	}
+	client, err := kafka.NewClient(brokers, newKafkaConfig(security))
+	if err != nil {
+		logrus.Fatalf("failed to connect to Kafka brokers %s: %v", brokers, err)
+	}
+	defer client.Close()
+	producer, err := kafka.NewSyncProducerFromClient(client)
+	if err != nil {
+		logrus.Fatalf("failed to create the dead-letter producer: %v", err)
+	}
+	defer producer.Close()
+	group, err := kafka.NewConsumerGroupFromClient(cfg.group, client)
+	if err != nil {
+		logrus.Fatalf("failed to join consumer group %s: %v", cfg.group, err)
+	}
+	defer group.Close()
+
+	handler := &consumer{
+		restorer: newRestorer(dynamicClient, clientset.Discovery(), store),
+		producer: producer,
+		cfg:      cfg,
+		locks:    newKeyedMutex(),
+	}
+
+	metricsServer := metrics.NewServer(cfg.metricsAddr)
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("metrics server failed: %v", err)
+		}
+	}()
+	defer metricsServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signalCh
+		logrus.Infof("received %s, shutting down", sig)
+		cancel()
+	}()
+
+	// Consume returns when the group rebalances, or when the topics to consume change, after which the session is
+	// rejoined with the new assignment.
+	topics := newTopicResolver(client, cfg)
+	var consumed []string
+	for ctx.Err() == nil {
+		resolved, err := topics.resolve()
+		if err != nil {
+			logrus.Errorf("failed to determine the topics to consume: %v", err)
+		} else {
+			if !reflect.DeepEqual(resolved, consumed) {
+				logrus.Infof("consuming reconcile requests from %v as consumer group %s", resolved, cfg.group)
+				consumed = resolved
+			}
+			sessionCtx, cancelSession := context.WithCancel(ctx)
+			go topics.watch(sessionCtx, consumed, cancelSession)
+			err = group.Consume(sessionCtx, consumed, handler)
+			cancelSession()
+			if err != nil {
+				logrus.Errorf("consumer group session failed: %v", err)
+			}
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(consumeRetryBackoff):
+			}
+		}
+	}
+}
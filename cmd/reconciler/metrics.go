@@ -0,0 +1,11 @@
+package main
+
+import "expvar"
+
+// Metrics are published with expvar and served as JSON on the metrics address, see metrics.NewServer.
+var (
+	metricRestored     = expvar.NewInt("heimdall_reconciler_restored_total")
+	metricUnchanged    = expvar.NewInt("heimdall_reconciler_unchanged_total")
+	metricRetries      = expvar.NewInt("heimdall_reconciler_retries_total")
+	metricDeadLettered = expvar.NewInt("heimdall_reconciler_dead_lettered_total")
+)
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"strings"
+	"sync"
+)
+
+// permanentError is an error that retrying the reconcile request would not resolve, e.g. because there is no snapshot
+// of the resource. Such requests are sent to the dead-letter topic right away.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent returns a permanentError with the given message.
+func permanent(format string, args ...interface{}) error {
+	return &permanentError{err: fmt.Errorf(format, args...)}
+}
+
+// isPermanent checks if err is a permanentError.
+func isPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
+
+// apiResource is the resource of a kind, as served by the API server.
+type apiResource struct {
+	gvr        schema.GroupVersionResource
+	namespaced bool
+}
+
+// restorer restores resources to the owner-approved state recorded in their snapshots.
+type restorer struct {
+	client    dynamic.Interface
+	discovery discovery.DiscoveryInterface
+	store     reconcile.SnapshotStore
+
+	mu        sync.Mutex
+	resources map[schema.GroupVersionKind]apiResource
+}
+
+func newRestorer(client dynamic.Interface, discovery discovery.DiscoveryInterface, store reconcile.SnapshotStore) *restorer {
+	return &restorer{
+		client:    client,
+		discovery: discovery,
+		store:     store,
+		resources: make(map[schema.GroupVersionKind]apiResource),
+	}
+}
+
+// restore restores the fields recorded in the snapshot of the resource of the given event. The patch is guarded by
+// the resourceVersion the fields were compared against, so a concurrent change makes it fail and the request is
+// retried against the new state.
+func (r *restorer) restore(ctx context.Context, event *reconcile.Event) error {
+	ref := reconcile.RefOf(event)
+	snapshot, err := r.store.Get(ctx, ref)
+	if err == reconcile.ErrNoSnapshot {
+		return permanent("no snapshot of %s", ref)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get the snapshot of %s: %v", ref, err)
+	}
+
+	// The snapshot's pointers refer to the version it was recorded in, which may differ from the event's.
+	resource, err := r.resource(schema.GroupVersionKind{Group: snapshot.Group, Version: snapshot.Version, Kind: snapshot.Kind})
+	if err != nil {
+		return err
+	}
+	resourceClient := r.client.Resource(resource.gvr)
+	var client dynamic.ResourceInterface = resourceClient
+	if resource.namespaced {
+		client = resourceClient.Namespace(ref.Namespace)
+	}
+
+	obj, err := client.Get(ctx, ref.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return permanent("%s no longer exists", ref)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %v", ref, err)
+	}
+	if snapshot.UID != "" && obj.GetUID() != snapshot.UID {
+		return permanent("%s was recreated since its snapshot was taken", ref)
+	}
+
+	ops := snapshot.RestorePatch(obj.Object)
+	if len(ops) == 0 {
+		logrus.Infof("%s is in the state approved by %s", ref, snapshot.Owner)
+		metricUnchanged.Add(1)
+		return nil
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return permanent("failed to encode the patch for %s: %v", ref, err)
+	}
+	if _, err := client.Patch(ctx, ref.Name, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return permanent("%s no longer exists", ref)
+		}
+		return fmt.Errorf("failed to patch %s: %v", ref, err)
+	}
+	logrus.Infof("restored %d fields of %s to the state approved by %s", len(ops)-1, ref, snapshot.Owner)
+	metricRestored.Add(1)
+	return nil
+}
+
+// resource returns the API resource serving the given kind, looking it up with discovery on first use.
+func (r *restorer) resource(gvk schema.GroupVersionKind) (apiResource, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resource, ok := r.resources[gvk]; ok {
+		return resource, nil
+	}
+
+	list, err := r.discovery.ServerResourcesForGroupVersion(gvk.GroupVersion().String())
+	if k8serrors.IsNotFound(err) {
+		return apiResource{}, permanent("%s is not served by the API server", gvk.GroupVersion())
+	}
+	if err != nil {
+		return apiResource{}, fmt.Errorf("failed to discover the resources of %s: %v", gvk.GroupVersion(), err)
+	}
+	for _, res := range list.APIResources {
+		// Subresources such as deployments/status share the kind of their parent.
+		if res.Kind != gvk.Kind || res.Group != "" && res.Group != gvk.Group || strings.Contains(res.Name, "/") {
+			continue
+		}
+		resource := apiResource{gvr: gvk.GroupVersion().WithResource(res.Name), namespaced: res.Namespaced}
+		r.resources[gvk] = resource
+		return resource, nil
+	}
+	return apiResource{}, permanent("kind %s is not served by the API server", gvk)
+}
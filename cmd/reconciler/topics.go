@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	kafka "github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"time"
+)
+
+// topicRefreshInterval is how often the existing topics are listed, so that topics created later, e.g. when the
+// admission controller switches to per-priority topics, are consumed without a restart.
+const topicRefreshInterval = time.Minute
+
+// topicResolver determines the topics to consume: the configured ones, or only the existing ones among them.
+type topicResolver struct {
+	client       kafka.Client
+	topics       []string
+	existingOnly bool
+	// interval is how often watch lists the existing topics.
+	interval time.Duration
+}
+
+func newTopicResolver(client kafka.Client, cfg *config) *topicResolver {
+	return &topicResolver{client: client, topics: cfg.topics, existingOnly: cfg.existingTopicsOnly, interval: topicRefreshInterval}
+}
+
+// resolve returns the topics to consume, in the configured order.
+func (r *topicResolver) resolve() ([]string, error) {
+	if !r.existingOnly {
+		return r.topics, nil
+	}
+	if err := r.client.RefreshMetadata(); err != nil {
+		return nil, fmt.Errorf("failed to list Kafka topics: %v", err)
+	}
+	existing, err := r.client.Topics()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Kafka topics: %v", err)
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, topic := range existing {
+		exists[topic] = true
+	}
+
+	var topics []string
+	for _, topic := range r.topics {
+		if exists[topic] {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("none of the topics %v exists", r.topics)
+	}
+	return topics, nil
+}
+
+// watch calls cancel once the topics to consume differ from the given ones, so that the consumer group session is
+// rejoined with them. It returns when ctx is done.
+func (r *topicResolver) watch(ctx context.Context, current []string, cancel context.CancelFunc) {
+	if !r.existingOnly {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		topics, err := r.resolve()
+		if err != nil {
+			logrus.Warnf("failed to refresh the consumed topics: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(topics, current) {
+			logrus.Infof("consumed topics changed to %v, rejoining the consumer group", topics)
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	kafka "github.com/Shopify/sarama"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testTopics = []string{"heimdall-topic", "heimdall-topic-critical", "heimdall-topic-high"}
+
+func TestTopicResolverResolve(t *testing.T) {
+	tests := []struct {
+		name         string
+		existingOnly bool
+		existing     []string
+		refreshErr   error
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:     "configured topics",
+			existing: []string{"heimdall-topic"},
+			want:     testTopics,
+		},
+		{
+			name:         "existing topics in the configured order",
+			existingOnly: true,
+			existing:     []string{"other", "heimdall-topic-high", "heimdall-topic-critical"},
+			want:         []string{"heimdall-topic-critical", "heimdall-topic-high"},
+		},
+		{
+			name:         "no existing topics",
+			existingOnly: true,
+			existing:     []string{"other"},
+			wantErr:      true,
+		},
+		{
+			name:         "metadata unavailable",
+			existingOnly: true,
+			existing:     testTopics,
+			refreshErr:   kafka.ErrOutOfBrokers,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeTopicsClient{topics: tt.existing, refreshErr: tt.refreshErr}
+			r := newTopicResolver(client, &config{topics: testTopics, existingTopicsOnly: tt.existingOnly})
+			got, err := r.resolve()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolve = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolve = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicResolverWatch(t *testing.T) {
+	client := &fakeTopicsClient{topics: []string{"heimdall-topic"}}
+	r := newTopicResolver(client, &config{topics: testTopics, existingTopicsOnly: true})
+	r.interval = time.Millisecond
+	current, err := r.resolve()
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sessionCtx, cancelSession := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		r.watch(ctx, current, cancelSession)
+		close(done)
+	}()
+
+	select {
+	case <-sessionCtx.Done():
+		t.Fatal("session canceled while the topics are unchanged")
+	case <-time.After(20 * time.Millisecond):
+	}
+	client.setTopics([]string{"heimdall-topic", "heimdall-topic-high"})
+	select {
+	case <-sessionCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not canceled after the topics changed")
+	}
+	<-done
+}
+
+// fakeTopicsClient lists the configured topics. Its other methods are not implemented.
+type fakeTopicsClient struct {
+	kafka.Client
+	refreshErr error
+
+	mu     sync.Mutex
+	topics []string
+}
+
+func (c *fakeTopicsClient) RefreshMetadata(...string) error {
+	return c.refreshErr
+}
+
+func (c *fakeTopicsClient) Topics() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topics, nil
+}
+
+func (c *fakeTopicsClient) setTopics(topics []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topics = topics
+}
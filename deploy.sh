@@ -14,6 +14,9 @@ kubectl -n heimdall create secret tls heimdall-admission-controller-tls \
     --cert "${keydir}/heimdall-admission-controller-tls.crt" \
     --key "${keydir}/heimdall-admission-controller-tls.key"
 
+# Create the HeimdallPolicy custom resource definition, which the webhook server watches on startup.
+kubectl create -f "${basedir}/heimdallpolicy-crd.yaml"
+
 # Read the PEM-encoded CA certificate, base64 encode it, and replace the `${CA_PEM_B64}` placeholder in the YAML
 # template with it. Then, create the Kubernetes resources.
 ca_pem_b64="$(openssl base64 -A <"${keydir}/ca.crt")"
@@ -0,0 +1,96 @@
+// Package env reads the configuration of the Heimdall binaries from environment variables.
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// String returns the value of the given environment variable, or def if it is unset or empty.
+func String(name, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
+
+// Bool parses the given environment variable as a boolean, returning def if it is unset or empty.
+func Bool(name string, def bool) (bool, error) {
+	v := String(name, "")
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for %s: %v", v, name, err)
+	}
+	return b, nil
+}
+
+// Int parses the given environment variable as a positive integer, returning def if it is unset or empty.
+func Int(name string, def int) (int, error) {
+	v := String(name, "")
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s: %v", v, name, err)
+	}
+	if i <= 0 {
+		return 0, fmt.Errorf("invalid value %q for %s: must be positive", v, name)
+	}
+	return i, nil
+}
+
+// NonNegativeInt parses the given environment variable as a non-negative integer, for settings where zero is
+// meaningful (e.g. no retries), returning def if it is unset or empty.
+func NonNegativeInt(name string, def int) (int, error) {
+	v := String(name, "")
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s: %v", v, name, err)
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("invalid value %q for %s: must not be negative", v, name)
+	}
+	return i, nil
+}
+
+// Duration parses the given environment variable as a positive duration (e.g. 30s), returning def if it is unset or
+// empty.
+func Duration(name string, def time.Duration) (time.Duration, error) {
+	v := String(name, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s: %v", v, name, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid value %q for %s: must be positive", v, name)
+	}
+	return d, nil
+}
+
+// List parses the given environment variable as a comma-separated list, returning def if it is unset or empty.
+func List(name string, def []string) []string {
+	v := String(name, "")
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,202 @@
+// Package jsonpointer resolves and compares JSON pointers (RFC 6901) in decoded JSON documents, i.e., the
+// map[string]interface{}, []interface{} and scalar values encoding/json decodes into.
+package jsonpointer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parse splits a JSON pointer into its unescaped reference tokens. The empty pointer refers to the whole document.
+func Parse(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must be empty or start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// Join joins reference tokens into a JSON pointer, the inverse of Parse.
+func Join(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(Escape(token))
+	}
+	return b.String()
+}
+
+// Compare orders JSON pointers, given as reference tokens, token by token, comparing array indices numerically: /a
+// comes before /a/b, and /a/2 before /a/10.
+func Compare(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		ai, aErr := strconv.Atoi(a[i])
+		bi, bErr := strconv.Atoi(b[i])
+		if aErr == nil && bErr == nil && ai != bi {
+			if ai < bi {
+				return -1
+			}
+			return 1
+		}
+		if a[i] < b[i] {
+			return -1
+		}
+		return 1
+	}
+	return len(a) - len(b)
+}
+
+// Escape escapes a single reference token of a JSON pointer.
+func Escape(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// Lookup returns the value the given reference tokens point to in a decoded JSON document. The second return value
+// is false if there is no such value.
+func Lookup(doc interface{}, tokens []string) (interface{}, bool) {
+	for _, token := range tokens {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[token]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// Set sets the value at the given reference tokens in a decoded JSON document, creating missing objects on the way,
+// and returns the document. Array elements must exist.
+func Set(doc interface{}, tokens []string, value interface{}) interface{} {
+	if len(tokens) == 0 {
+		return value
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		child, exists := v[tokens[0]]
+		if !exists {
+			child = map[string]interface{}{}
+		}
+		v[tokens[0]] = Set(child, tokens[1:], value)
+	case []interface{}:
+		if i, err := strconv.Atoi(tokens[0]); err == nil && i >= 0 && i < len(v) {
+			v[i] = Set(v[i], tokens[1:], value)
+		}
+	}
+	return doc
+}
+
+// Remove removes the value at the given reference tokens from a decoded JSON document, and returns the document.
+// Removing an array element shifts the following ones.
+func Remove(doc interface{}, tokens []string) interface{} {
+	if len(tokens) == 0 {
+		return nil
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		child, exists := v[tokens[0]]
+		if !exists {
+			break
+		}
+		if len(tokens) == 1 {
+			delete(v, tokens[0])
+		} else {
+			v[tokens[0]] = Remove(child, tokens[1:])
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(tokens[0])
+		if err != nil || i < 0 || i >= len(v) {
+			break
+		}
+		if len(tokens) == 1 {
+			return append(v[:i:i], v[i+1:]...)
+		}
+		v[i] = Remove(v[i], tokens[1:])
+	}
+	return doc
+}
+
+// Diff appends to changes the JSON pointers of all values that differ between two decoded JSON documents, rooted
+// at the given pointer. Objects are compared key by key and arrays of equal length element by element, any other
+// difference is reported at the level where it occurs.
+func Diff(a, b interface{}, pointer string, changes []string) []string {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPointer := pointer + "/" + Escape(k)
+			aChild, aOK := av[k]
+			bChild, bOK := bv[k]
+			if aOK != bOK {
+				changes = append(changes, childPointer)
+				continue
+			}
+			changes = Diff(aChild, bChild, childPointer, changes)
+		}
+		return changes
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			break
+		}
+		for i := range av {
+			changes = Diff(av[i], bv[i], pointer+"/"+strconv.Itoa(i), changes)
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		changes = append(changes, pointer)
+	}
+	return changes
+}
+
+// IsUnder checks if the given pointer refers to the value at prefix or a value nested within it.
+func IsUnder(pointer, prefix string) bool {
+	return prefix == "" || pointer == prefix || strings.HasPrefix(pointer, prefix+"/")
+}
+
+// IsUnderAny checks if the given pointer is under any of the given prefixes, see IsUnder.
+func IsUnderAny(pointer string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if IsUnder(pointer, prefix) {
+			return true
+		}
+	}
+	return false
+}
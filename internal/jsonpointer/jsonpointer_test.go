@@ -0,0 +1,26 @@
+package jsonpointer
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "/a", b: "/a", want: 0},
+		{a: "/a", b: "/a/b", want: -1},
+		{a: "/a/b", b: "/a", want: 1},
+		{a: "/a/2", b: "/a/10", want: -1},
+		{a: "/a/10", b: "/a/2", want: 1},
+		{a: "/a/b", b: "/a/c", want: -1},
+		{a: "/a/10/b", b: "/a/9/c", want: 1},
+	}
+	for _, tt := range tests {
+		a, _ := Parse(tt.a)
+		b, _ := Parse(tt.b)
+		got := Compare(a, b)
+		if (got < 0) != (tt.want < 0) || (got > 0) != (tt.want > 0) {
+			t.Errorf("Compare(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
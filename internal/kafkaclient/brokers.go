@@ -0,0 +1,144 @@
+package kafkaclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kafkaGVR is the Strimzi Kafka custom resource, whose status lists the bootstrap addresses of its listeners.
+var kafkaGVR = schema.GroupVersionResource{Group: "kafka.strimzi.io", Version: "v1beta2", Resource: "kafkas"}
+
+// brokerSyncTimeout bounds the initial sync of the Kafka resource informer at startup.
+const brokerSyncTimeout = 10 * time.Second
+
+// ErrBrokersNotSynced is returned by BrokerDiscovery.Brokers until the Kafka resource has been synced.
+var ErrBrokersNotSynced = errors.New("Kafka resource not synced yet")
+
+// BrokerDiscovery resolves the bootstrap brokers of the Kafka cluster, either from a static list or from the status of
+// the Strimzi Kafka resource, which is kept up to date by an informer.
+type BrokerDiscovery struct {
+	static []string
+
+	namespace string
+	cluster   string
+	listener  string
+	informer  cache.SharedIndexInformer
+	kafkas    cache.GenericNamespaceLister
+}
+
+// NewBrokerDiscovery creates the broker discovery configured in cfg. Unless static brokers are configured, it starts an
+// informer watching the Kafka resource and waits up to brokerSyncTimeout for it to sync; Brokers fails until it has.
+func NewBrokerDiscovery(client dynamic.Interface, cfg *Config, stopCh <-chan struct{}) *BrokerDiscovery {
+	d := &BrokerDiscovery{
+		static:    cfg.Brokers,
+		namespace: cfg.Namespace,
+		cluster:   cfg.Cluster,
+		listener:  cfg.Listener,
+	}
+	if len(d.static) > 0 {
+		return d
+	}
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 10*time.Minute, d.namespace,
+		func(opts *metav1.ListOptions) {
+			opts.FieldSelector = "metadata.name=" + d.cluster
+		})
+	informer := factory.ForResource(kafkaGVR)
+	d.informer = informer.Informer()
+	d.kafkas = informer.Lister().ByNamespace(d.namespace)
+	factory.Start(stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), brokerSyncTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), d.informer.HasSynced) {
+		logrus.Warnf("Kafka %s/%s not synced after %s", d.namespace, d.cluster, brokerSyncTimeout)
+	}
+	return d
+}
+
+// Brokers returns the bootstrap brokers of the configured listener.
+func (d *BrokerDiscovery) Brokers() ([]string, error) {
+	if len(d.static) > 0 {
+		return d.static, nil
+	}
+	if !d.informer.HasSynced() {
+		return nil, ErrBrokersNotSynced
+	}
+
+	obj, err := d.kafkas.Get(d.cluster)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kafka %s/%s: %v", d.namespace, d.cluster, err)
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected Kafka object %T", obj)
+	}
+	listeners, _, err := unstructured.NestedSlice(u.Object, "status", "listeners")
+	if err != nil {
+		return nil, fmt.Errorf("malformed status of Kafka %s/%s: %v", d.namespace, d.cluster, err)
+	}
+
+	for _, l := range listeners {
+		listener, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// Strimzi versions before 0.25 identify listeners by type.
+		name, _, _ := unstructured.NestedString(listener, "name")
+		if name == "" {
+			name, _, _ = unstructured.NestedString(listener, "type")
+		}
+		if name != d.listener {
+			continue
+		}
+		if brokers := listenerBrokers(listener); len(brokers) > 0 {
+			return brokers, nil
+		}
+	}
+	return nil, fmt.Errorf("Kafka %s/%s has no addresses for listener %q", d.namespace, d.cluster, d.listener)
+}
+
+// listenerBrokers returns the bootstrap addresses of the given listener status.
+func listenerBrokers(listener map[string]interface{}) []string {
+	var brokers []string
+	if bootstrap, _, _ := unstructured.NestedString(listener, "bootstrapServers"); bootstrap != "" {
+		for _, broker := range strings.Split(bootstrap, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				brokers = append(brokers, broker)
+			}
+		}
+		return brokers
+	}
+
+	addresses, _, _ := unstructured.NestedSlice(listener, "addresses")
+	for _, a := range addresses {
+		address, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		host, _, _ := unstructured.NestedString(address, "host")
+		port, _, _ := unstructured.NestedInt64(address, "port")
+		if host != "" && port > 0 {
+			brokers = append(brokers, host+":"+strconv.FormatInt(port, 10))
+		}
+	}
+	return brokers
+}
@@ -0,0 +1,70 @@
+// Package kafkaclient connects the Heimdall binaries to Kafka: it reads the connection settings they share from the
+// environment, loads the TLS and SASL material from mounted Secrets, and discovers the bootstrap brokers from the
+// status of a Strimzi Kafka resource.
+package kafkaclient
+
+import (
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/env"
+	"path/filepath"
+)
+
+// Config holds the settings for connecting to Kafka.
+type Config struct {
+	// Brokers is a static list of bootstrap brokers. If empty, they are discovered from the status of the Strimzi
+	// Kafka resource Cluster in Namespace, using its listener Listener.
+	Brokers   []string
+	Namespace string
+	Cluster   string
+	Listener  string
+	// TLS enables TLS for connecting to Kafka.
+	TLS bool
+	// CAFile is the CA bundle the Kafka brokers' certificates are verified against, the system roots if empty.
+	CAFile string
+	// ClientCertFile and ClientKeyFile are the client certificate for mTLS authentication.
+	ClientCertFile string
+	ClientKeyFile  string
+	// SASLMechanism is the SASL mechanism for authenticating to Kafka, SASL is disabled if empty.
+	SASLMechanism SASLMechanism
+	// SASLUsername and SASLPasswordFile are the SASL credentials.
+	SASLUsername     string
+	SASLPasswordFile string
+	// UserDir is a mounted Strimzi KafkaUser Secret, providing the client certificate or SASL credentials that are not
+	// configured explicitly.
+	UserDir string
+}
+
+// LoadConfig reads the connection settings from the HEIMDALL_KAFKA_* environment variables, applying defaults for
+// unset variables.
+func LoadConfig() (Config, error) {
+	cfg := Config{}
+	var err error
+
+	cfg.CAFile = env.String("HEIMDALL_KAFKA_CA_FILE", "")
+	cfg.ClientCertFile = env.String("HEIMDALL_KAFKA_CLIENT_CERT_FILE", "")
+	cfg.ClientKeyFile = env.String("HEIMDALL_KAFKA_CLIENT_KEY_FILE", "")
+	if (cfg.ClientCertFile == "") != (cfg.ClientKeyFile == "") {
+		return Config{}, fmt.Errorf("HEIMDALL_KAFKA_CLIENT_CERT_FILE and HEIMDALL_KAFKA_CLIENT_KEY_FILE must be set together")
+	}
+	cfg.UserDir = env.String("HEIMDALL_KAFKA_USER_DIR", "")
+	// A client certificate, configured explicitly or provided by the KafkaUser, is only used over TLS.
+	userCert := cfg.UserDir != "" && fileExists(filepath.Join(cfg.UserDir, kafkaUserCertFile))
+	if cfg.TLS, err = env.Bool("HEIMDALL_KAFKA_TLS", cfg.CAFile != "" || cfg.ClientCertFile != "" || userCert); err != nil {
+		return Config{}, err
+	}
+	cfg.Brokers = env.List("HEIMDALL_KAFKA_BROKERS", nil)
+	cfg.Namespace = env.String("HEIMDALL_KAFKA_NAMESPACE", "heimdall")
+	cfg.Cluster = env.String("HEIMDALL_KAFKA_CLUSTER", "heimdall-kafka-cluster")
+	defaultListener := "plain"
+	if cfg.TLS {
+		defaultListener = "tls"
+	}
+	cfg.Listener = env.String("HEIMDALL_KAFKA_LISTENER", defaultListener)
+	if cfg.SASLMechanism, err = ParseSASLMechanism(env.String("HEIMDALL_KAFKA_SASL_MECHANISM", "")); err != nil {
+		return Config{}, fmt.Errorf("invalid value for HEIMDALL_KAFKA_SASL_MECHANISM: %v", err)
+	}
+	cfg.SASLUsername = env.String("HEIMDALL_KAFKA_SASL_USERNAME", "")
+	cfg.SASLPasswordFile = env.String("HEIMDALL_KAFKA_SASL_PASSWORD_FILE", "")
+
+	return cfg, nil
+}
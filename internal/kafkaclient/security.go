@@ -0,0 +1,194 @@
+package kafkaclient
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	kafka "github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files of a Strimzi KafkaUser Secret, see https://strimzi.io/docs/operators/latest/configuring.html#type-KafkaUser-reference.
+const (
+	kafkaUserCertFile     = "user.crt"
+	kafkaUserKeyFile      = "user.key"
+	kafkaUserPasswordFile = "password"
+	kafkaUserJAASFile     = "sasl.jaas.config"
+)
+
+// jaasUsernamePattern extracts the username from the JAAS configuration of a SCRAM KafkaUser.
+var jaasUsernamePattern = regexp.MustCompile(`username="([^"]*)"`)
+
+// SASLMechanism is a SASL mechanism for authenticating to Kafka.
+type SASLMechanism string
+
+const (
+	SASLNone        SASLMechanism = ""
+	SASLPlain       SASLMechanism = kafka.SASLTypePlaintext
+	SASLSCRAMSHA256 SASLMechanism = kafka.SASLTypeSCRAMSHA256
+	SASLSCRAMSHA512 SASLMechanism = kafka.SASLTypeSCRAMSHA512
+)
+
+func ParseSASLMechanism(s string) (SASLMechanism, error) {
+	switch m := SASLMechanism(s); m {
+	case SASLNone, SASLPlain, SASLSCRAMSHA256, SASLSCRAMSHA512:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid SASL mechanism %q, must be one of %s, %s or %s", s,
+		SASLPlain, SASLSCRAMSHA256, SASLSCRAMSHA512)
+}
+
+// Security is the TLS and SASL configuration for connecting to Kafka, loaded from files mounted from Secrets.
+type Security struct {
+	tlsConfig *tls.Config
+
+	mechanism SASLMechanism
+	username  string
+	password  string
+
+	// Fingerprint identifies the loaded files, so that rotated Secrets can be detected.
+	Fingerprint string
+}
+
+// LoadSecurity reads the TLS and SASL material configured for Kafka. Files missing from a Strimzi KafkaUser directory
+// are skipped, all other configured files must exist.
+func LoadSecurity(cfg *Config) (*Security, error) {
+	s := &Security{mechanism: cfg.SASLMechanism, username: cfg.SASLUsername}
+	hash := sha256.New()
+	readFile := func(path string) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		hash.Write([]byte(path))
+		hash.Write(data)
+		return data, nil
+	}
+
+	certFile, keyFile, passwordFile := cfg.ClientCertFile, cfg.ClientKeyFile, cfg.SASLPasswordFile
+	if dir := cfg.UserDir; dir != "" {
+		// A KafkaUser Secret either holds a client certificate (tls authentication) or a password (scram-sha-512).
+		if certFile == "" && fileExists(filepath.Join(dir, kafkaUserCertFile)) {
+			certFile, keyFile = filepath.Join(dir, kafkaUserCertFile), filepath.Join(dir, kafkaUserKeyFile)
+		}
+		if passwordFile == "" && fileExists(filepath.Join(dir, kafkaUserPasswordFile)) {
+			passwordFile = filepath.Join(dir, kafkaUserPasswordFile)
+			if s.mechanism == SASLNone {
+				s.mechanism = SASLSCRAMSHA512
+			}
+			if s.username == "" {
+				jaas, err := readFile(filepath.Join(dir, kafkaUserJAASFile))
+				if err != nil {
+					return nil, err
+				}
+				match := jaasUsernamePattern.FindSubmatch(jaas)
+				if match == nil {
+					return nil, fmt.Errorf("no username in %s", filepath.Join(dir, kafkaUserJAASFile))
+				}
+				s.username = string(match[1])
+			}
+		}
+	}
+
+	if cfg.TLS {
+		s.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.CAFile != "" {
+			caPEM, err := readFile(cfg.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			s.tlsConfig.RootCAs = x509.NewCertPool()
+			if !s.tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+			}
+		}
+		if certFile != "" {
+			certPEM, err := readFile(certFile)
+			if err != nil {
+				return nil, err
+			}
+			keyPEM, err := readFile(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client certificate: %v", err)
+			}
+			s.tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	} else if certFile != "" {
+		return nil, errors.New("a client certificate requires TLS")
+	}
+
+	if s.mechanism != SASLNone {
+		if passwordFile == "" || s.username == "" {
+			return nil, fmt.Errorf("SASL mechanism %s requires a username and a password", s.mechanism)
+		}
+		password, err := readFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		s.password = strings.TrimSpace(string(password))
+	}
+
+	s.Fingerprint = hex.EncodeToString(hash.Sum(nil))
+	return s, nil
+}
+
+// Apply sets the TLS and SASL options of the given Kafka client configuration.
+func (s *Security) Apply(config *kafka.Config) {
+	if s.tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = s.tlsConfig
+	}
+	if s.mechanism == SASLNone {
+		return
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.Mechanism = kafka.SASLMechanism(s.mechanism)
+	config.Net.SASL.User = s.username
+	config.Net.SASL.Password = s.password
+	switch s.mechanism {
+	case SASLSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() kafka.SCRAMClient { return &scramClient{hashGen: scram.SHA256} }
+	case SASLSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() kafka.SCRAMClient { return &scramClient{hashGen: scram.SHA512} }
+	}
+}
+
+// scramClient implements the SCRAM conversation for sarama.
+type scramClient struct {
+	hashGen      scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(username, password, authzID string) error {
+	client, err := c.hashGen.NewClient(username, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
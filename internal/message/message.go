@@ -0,0 +1,144 @@
+// Package message encodes the reconcile events of the admission controller as Kafka messages, as plain JSON or as
+// CloudEvents in binary or structured mode, and decodes them for consumers such as the reconciler.
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	// cloudEventsTypePrefix prefixes the type of reconcile CloudEvents, followed by the group, version and kind of the
+	// resource, e.g. io.heimdall.reconcile.apps.v1.Deployment.
+	cloudEventsTypePrefix = "io.heimdall.reconcile"
+	// cloudEventsHeaderPrefix prefixes the attributes of binary mode CloudEvents in Kafka headers.
+	cloudEventsHeaderPrefix = "ce_"
+
+	contentTypeHeader          = "content-type"
+	jsonContentType            = "application/json"
+	cloudEventsJSONContentType = "application/cloudevents+json"
+)
+
+// Encoding determines how reconcile events are encoded in Kafka messages.
+type Encoding string
+
+const (
+	// EncodingJSON encodes the event as plain JSON.
+	EncodingJSON Encoding = "json"
+	// EncodingCloudEventsBinary encodes the event as a CloudEvent in binary mode: the attributes are set as ce_*
+	// headers and the value is the JSON event.
+	EncodingCloudEventsBinary Encoding = "cloudevents-binary"
+	// EncodingCloudEventsStructured encodes the event as a CloudEvent in structured mode: the value is a JSON
+	// CloudEvent, with the JSON event as its data.
+	EncodingCloudEventsStructured Encoding = "cloudevents-structured"
+)
+
+func ParseEncoding(s string) (Encoding, error) {
+	switch encoding := Encoding(s); encoding {
+	case EncodingJSON, EncodingCloudEventsBinary, EncodingCloudEventsStructured:
+		return encoding, nil
+	}
+	return "", fmt.Errorf("invalid message encoding %q, must be one of %s, %s or %s", s,
+		EncodingJSON, EncodingCloudEventsBinary, EncodingCloudEventsStructured)
+}
+
+// Header is a header of a Kafka message.
+type Header struct {
+	Key   string
+	Value string
+}
+
+// Encode encodes the given reconcile event as the headers and value of a Kafka message.
+func Encode(event *reconcile.Event, encoding Encoding) ([]Header, []byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch encoding {
+	case EncodingCloudEventsBinary:
+		var headers []Header
+		for _, attr := range cloudEventAttributes(event) {
+			headers = append(headers, Header{Key: cloudEventsHeaderPrefix + attr.Key, Value: attr.Value})
+		}
+		headers = append(headers, Header{Key: contentTypeHeader, Value: jsonContentType})
+		return headers, data, nil
+
+	case EncodingCloudEventsStructured:
+		cloudEvent := map[string]interface{}{
+			"datacontenttype": jsonContentType,
+			"data":            json.RawMessage(data),
+		}
+		for _, attr := range cloudEventAttributes(event) {
+			cloudEvent[attr.Key] = attr.Value
+		}
+		value, err := json.Marshal(cloudEvent)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []Header{{Key: contentTypeHeader, Value: cloudEventsJSONContentType}}, value, nil
+	}
+
+	return nil, data, nil
+}
+
+// Decode decodes the reconcile event of a Kafka message with the given headers and value, in any of the encodings.
+func Decode(headers []Header, value []byte) (*reconcile.Event, error) {
+	data := value
+	for _, header := range headers {
+		if header.Key != contentTypeHeader || header.Value != cloudEventsJSONContentType {
+			continue
+		}
+		// A structured mode CloudEvent, the event is its data.
+		var cloudEvent struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(value, &cloudEvent); err != nil {
+			return nil, fmt.Errorf("invalid CloudEvent: %v", err)
+		}
+		data = cloudEvent.Data
+	}
+
+	event := &reconcile.Event{}
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, err
+	}
+	if event.SchemaVersion > reconcile.SchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d", event.SchemaVersion)
+	}
+	if event.Kind == "" || event.Name == "" {
+		return nil, fmt.Errorf("event does not identify a resource")
+	}
+	return event, nil
+}
+
+// cloudEventAttributes returns the CloudEvents context attributes of the given reconcile event, except for the data
+// content type, which depends on the mode.
+//
+// The type identifies the kind of the resource, e.g. io.heimdall.reconcile.apps.v1.Deployment, the source is the API
+// path of its namespace, e.g. /apis/apps/v1/namespaces/team-a, and the subject is its name.
+func cloudEventAttributes(event *reconcile.Event) []Header {
+	group := event.Group
+	source := path.Join("/apis", event.Group, event.Version)
+	if group == "" {
+		group = "core"
+		source = path.Join("/api", event.Version)
+	}
+	if event.Namespace != "" {
+		source = path.Join(source, "namespaces", event.Namespace)
+	}
+
+	return []Header{
+		{Key: "specversion", Value: cloudEventsSpecVersion},
+		{Key: "id", Value: event.MessageID.String()},
+		{Key: "source", Value: source},
+		{Key: "type", Value: strings.Join([]string{cloudEventsTypePrefix, group, event.Version, event.Kind}, ".")},
+		{Key: "subject", Value: event.Name},
+		{Key: "time", Value: event.Timestamp.Format(time.RFC3339Nano)},
+	}
+}
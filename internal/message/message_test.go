@@ -0,0 +1,154 @@
+package message
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/stackrox/admission-controller-heimdall/pkg/reconcile"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	event := &reconcile.Event{
+		MessageID:       uuid.MustParse("3f0c2a6e-5b8f-4c1e-9a57-0d2f3b4c5d6e"),
+		Name:            "web",
+		Namespace:       "team-a",
+		Kind:            "Deployment",
+		Group:           "apps",
+		Version:         "v1",
+		Operation:       "UPDATE",
+		SchemaVersion:   reconcile.SchemaVersion,
+		UID:             "8d1c7a2e",
+		ResourceVersion: "42",
+		User:            reconcile.User{Username: "jane", UID: "1000", Groups: []string{"system:authenticated"}},
+		Owner:           "sa:team-a:deployer",
+		Priority:        "high",
+		Timestamp:       time.Date(2023, 4, 5, 6, 7, 8, 9, time.UTC),
+		Reason:          "non-owner user jane cannot change protected fields: /spec/replicas",
+		Diff:            []reconcile.Change{{Path: "/spec/replicas", Old: 3.0, New: 5.0}},
+		RequestUID:      "b4e3c9f1",
+		Suppressed:      2,
+	}
+	wantAttributes := map[string]string{
+		"specversion": "1.0",
+		"id":          "3f0c2a6e-5b8f-4c1e-9a57-0d2f3b4c5d6e",
+		"source":      "/apis/apps/v1/namespaces/team-a",
+		"type":        "io.heimdall.reconcile.apps.v1.Deployment",
+		"subject":     "web",
+		"time":        "2023-04-05T06:07:08.000000009Z",
+	}
+
+	tests := []struct {
+		encoding Encoding
+		// wantHeaders are the expected headers, wantAttributes the expected CloudEvent attributes in the value.
+		wantHeaders    map[string]string
+		wantAttributes map[string]string
+	}{
+		{
+			encoding:    EncodingJSON,
+			wantHeaders: map[string]string{},
+		},
+		{
+			encoding: EncodingCloudEventsBinary,
+			wantHeaders: map[string]string{
+				"ce_specversion": "1.0",
+				"ce_id":          "3f0c2a6e-5b8f-4c1e-9a57-0d2f3b4c5d6e",
+				"ce_source":      "/apis/apps/v1/namespaces/team-a",
+				"ce_type":        "io.heimdall.reconcile.apps.v1.Deployment",
+				"ce_subject":     "web",
+				"ce_time":        "2023-04-05T06:07:08.000000009Z",
+				"content-type":   "application/json",
+			},
+		},
+		{
+			encoding:       EncodingCloudEventsStructured,
+			wantHeaders:    map[string]string{"content-type": "application/cloudevents+json"},
+			wantAttributes: wantAttributes,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.encoding), func(t *testing.T) {
+			headers, value, err := Encode(event, tt.encoding)
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			gotHeaders := make(map[string]string)
+			for _, header := range headers {
+				gotHeaders[header.Key] = header.Value
+			}
+			if !reflect.DeepEqual(gotHeaders, tt.wantHeaders) {
+				t.Errorf("headers = %v, want %v", gotHeaders, tt.wantHeaders)
+			}
+			if tt.wantAttributes != nil {
+				var cloudEvent map[string]interface{}
+				if err := json.Unmarshal(value, &cloudEvent); err != nil {
+					t.Fatalf("invalid CloudEvent %s: %v", value, err)
+				}
+				for key, want := range tt.wantAttributes {
+					if got := cloudEvent[key]; got != want {
+						t.Errorf("CloudEvent %s = %v, want %s", key, got, want)
+					}
+				}
+				if got := cloudEvent["datacontenttype"]; got != "application/json" {
+					t.Errorf("CloudEvent datacontenttype = %v, want application/json", got)
+				}
+			}
+
+			// Consumers receive the headers the producer adds as well.
+			headers = append(headers, Header{Key: "heimdall-priority", Value: "high"})
+			got, err := Decode(headers, value)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, event) {
+				t.Errorf("Decode = %+v, want %+v", got, event)
+			}
+		})
+	}
+}
+
+func TestCloudEventAttributes(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      *reconcile.Event
+		wantSource string
+		wantType   string
+	}{
+		{
+			name:       "namespaced",
+			event:      &reconcile.Event{Name: "web", Namespace: "team-a", Kind: "Deployment", Group: "apps", Version: "v1"},
+			wantSource: "/apis/apps/v1/namespaces/team-a",
+			wantType:   "io.heimdall.reconcile.apps.v1.Deployment",
+		},
+		{
+			name:       "core group",
+			event:      &reconcile.Event{Name: "web", Namespace: "team-a", Kind: "Service", Version: "v1"},
+			wantSource: "/api/v1/namespaces/team-a",
+			wantType:   "io.heimdall.reconcile.core.v1.Service",
+		},
+		{
+			name:       "cluster-scoped",
+			event:      &reconcile.Event{Name: "team-a", Kind: "Namespace", Version: "v1"},
+			wantSource: "/api/v1",
+			wantType:   "io.heimdall.reconcile.core.v1.Namespace",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attributes := make(map[string]string)
+			for _, attr := range cloudEventAttributes(tt.event) {
+				attributes[attr.Key] = attr.Value
+			}
+			if attributes["source"] != tt.wantSource {
+				t.Errorf("source = %s, want %s", attributes["source"], tt.wantSource)
+			}
+			if attributes["type"] != tt.wantType {
+				t.Errorf("type = %s, want %s", attributes["type"], tt.wantType)
+			}
+			if attributes["subject"] != tt.event.Name {
+				t.Errorf("subject = %s, want %s", attributes["subject"], tt.event.Name)
+			}
+		})
+	}
+}
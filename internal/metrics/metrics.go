@@ -0,0 +1,17 @@
+// Package metrics serves the metrics the Heimdall binaries publish with expvar.
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// NewServer creates the plain HTTP server exposing the metrics as JSON on /metrics at the given address.
+func NewServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", expvar.Handler())
+	return &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+}
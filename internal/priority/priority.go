@@ -0,0 +1,44 @@
+// Package priority defines the reconcile priorities of resources, set by their app.heimdall.io/priority label, and the
+// Kafka topics the admission controller publishes reconcile requests to: the Heimdall topic, or a topic per priority.
+package priority
+
+import "fmt"
+
+// Topic is the Kafka topic of reconcile requests that are not routed by priority.
+const Topic = "heimdall-topic"
+
+// Priority is the reconcile priority of a resource.
+type Priority string
+
+const (
+	Low      Priority = "low"
+	Medium   Priority = "medium"
+	High     Priority = "high"
+	Critical Priority = "critical"
+)
+
+// All are all priorities, highest first.
+var All = []Priority{Critical, High, Medium, Low}
+
+func Parse(s string) (Priority, error) {
+	switch p := Priority(s); p {
+	case Low, Medium, High, Critical:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid priority %q, must be one of %s, %s, %s or %s", s, Low, Medium, High, Critical)
+}
+
+// Topic returns the Kafka topic for reconcile requests of the priority, if they are routed to per-priority topics.
+func (p Priority) Topic() string {
+	return Topic + "-" + string(p)
+}
+
+// Topics returns all topics reconcile requests are published to: the Heimdall topic, followed by the topics of all
+// priorities, highest first.
+func Topics() []string {
+	topics := []string{Topic}
+	for _, p := range All {
+		topics = append(topics, p.Topic())
+	}
+	return topics
+}
@@ -0,0 +1,19 @@
+// Package reconcile defines the reconcile events the Heimdall admission controller publishes when a non-owner changes
+// or deletes an owned resource, and which consumers such as the reconciler decode. It also defines the snapshots of
+// the owner-approved state of a resource, which the admission controller records and consumers restore, and the
+// SnapshotStore implementations they are kept in: in memory, in ConfigMaps or Secrets, or in local files.
+//
+// Events are encoded as JSON objects. Their schema is versioned by the SchemaVersion field, and evolves under the
+// following compatibility policy:
+//
+//   - Adding fields is a compatible change and does not bump the schema version. Consumers must ignore fields they do
+//     not know.
+//   - Removing or renaming a field, or changing its type or meaning, is an incompatible change and bumps the schema
+//     version. Such changes are announced in the release notes one release ahead.
+//   - The fields of the original, unversioned messages (MessageID, Name, Namespace, Kind, Group, Version and
+//     Operation) keep their names and meaning in every schema version, so that consumers written against them keep
+//     working.
+//
+// Messages without a SchemaVersion field were published before the schema was versioned and only carry the original
+// fields, consumers should treat them as schema version 0.
+package reconcile
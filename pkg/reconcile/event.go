@@ -0,0 +1,66 @@
+package reconcile
+
+import (
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+// SchemaVersion is the version of the event schema published by this version of Heimdall.
+const SchemaVersion = 1
+
+// Event is a request to reconcile a resource after a non-owner changed or deleted it.
+type Event struct {
+	// MessageID uniquely identifies the event.
+	MessageID uuid.UUID
+	// Name and Namespace identify the resource, Namespace is empty for cluster-scoped resources.
+	Name      string
+	Namespace string
+	// Kind, Group and Version are the kind of the resource.
+	Kind    string
+	Group   string
+	Version string
+	// Operation is the admission operation, UPDATE or DELETE.
+	Operation string
+
+	// SchemaVersion is the version of the schema of the event, see the package documentation.
+	SchemaVersion int
+	// UID and ResourceVersion identify the state of the resource before the change.
+	UID             types.UID `json:",omitempty"`
+	ResourceVersion string    `json:",omitempty"`
+	// User is the user who made the change.
+	User User
+	// Owner is the owner of the resource, e.g. user:jane or sa:team-a:deployer.
+	Owner string `json:",omitempty"`
+	// Priority is the app.heimdall.io/priority label of the resource.
+	Priority string `json:",omitempty"`
+	// Timestamp is when the change was admitted or denied.
+	Timestamp time.Time
+	// Reason describes the violation, e.g. "non-owner user jane cannot change protected fields: /spec/replicas".
+	Reason string
+	// Diff lists the changes the request made to the resource, except for server-managed metadata. It is empty for
+	// deletions.
+	Diff []Change `json:",omitempty"`
+	// RequestUID is the UID of the admission request, which the API server keeps when it retries the request.
+	RequestUID types.UID `json:",omitempty"`
+	// Suppressed is the number of further reconcile requests for the resource that were coalesced into this one,
+	// because they followed an earlier request within the coalescing window. The event describes the latest of them.
+	Suppressed int `json:",omitempty"`
+}
+
+// User identifies the user who made a change.
+type User struct {
+	Username string
+	UID      string   `json:",omitempty"`
+	Groups   []string `json:",omitempty"`
+}
+
+// Change is a value that differs between the resource before and after the request.
+type Change struct {
+	// Path is the JSON pointer (RFC 6901) of the value.
+	Path string
+	// Old is the value before the request, absent if the request added it.
+	Old interface{} `json:",omitempty"`
+	// New is the value after the request, absent if the request removed it.
+	New interface{} `json:",omitempty"`
+}
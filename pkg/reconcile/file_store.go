@@ -0,0 +1,125 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshotFileSuffix is the suffix of the snapshot files of a FileSnapshotStore.
+const snapshotFileSuffix = ".json"
+
+// FileSnapshotStore stores each snapshot as a JSON file of its own in a local directory, e.g. a volume shared with a
+// reconciler running as a sidecar.
+type FileSnapshotStore struct {
+	dir       string
+	retention Retention
+}
+
+// NewFileSnapshotStore returns a store keeping the snapshots in the given directory, which is created if missing.
+func NewFileSnapshotStore(dir string, retention Retention) (*FileSnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileSnapshotStore{dir: dir, retention: retention}, nil
+}
+
+// path returns the path of the file holding the snapshot of the given resource.
+func (s *FileSnapshotStore) path(ref ResourceRef) string {
+	return filepath.Join(s.dir, snapshotObjectName(ref)+snapshotFileSuffix)
+}
+
+func (s *FileSnapshotStore) Get(_ context.Context, ref ResourceRef) (*Snapshot, error) {
+	snapshot, err := s.read(s.path(ref))
+	if os.IsNotExist(err) {
+		return nil, ErrNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.retention.expired(snapshot.Timestamp, time.Now()) {
+		return nil, ErrNoSnapshot
+	}
+	return snapshot, nil
+}
+
+func (s *FileSnapshotStore) Put(_ context.Context, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so that readers never see a partial snapshot.
+	tmp, err := os.CreateTemp(s.dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(snapshot.ResourceRef))
+}
+
+func (s *FileSnapshotStore) Delete(_ context.Context, ref ResourceRef) error {
+	if err := os.Remove(s.path(ref)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileSnapshotStore) Prune(context.Context) (int, error) {
+	if s.retention == (Retention{}) {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	timestamps := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), snapshotFileSuffix) {
+			continue
+		}
+		path := filepath.Join(s.dir, entry.Name())
+		snapshot, err := s.read(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			// Undecodable snapshots are treated as oldest, so that they are pruned first.
+			timestamps[path] = time.Time{}
+			continue
+		}
+		timestamps[path] = snapshot.Timestamp
+	}
+
+	pruned := 0
+	for _, path := range s.retention.prune(timestamps, time.Now()) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// read decodes the snapshot file at the given path.
+func (s *FileSnapshotStore) read(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot in %s: %v", path, err)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,207 @@
+package reconcile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+const (
+	// snapshotLabel marks the ConfigMaps and Secrets holding snapshots.
+	snapshotLabel = "app.heimdall.io/snapshot"
+	// snapshotResourceAnnotation records the resource of a snapshot object, whose name is a hash.
+	snapshotResourceAnnotation = "app.heimdall.io/snapshot-of"
+	// snapshotTimestampAnnotation and snapshotHashAnnotation record the timestamp and hash of the snapshot, so that
+	// snapshot objects can be pruned and compared without decoding them.
+	snapshotTimestampAnnotation = "app.heimdall.io/snapshot-timestamp"
+	snapshotHashAnnotation      = "app.heimdall.io/snapshot-hash"
+	// snapshotKey is the ConfigMap or Secret key of the snapshot.
+	snapshotKey = "snapshot.json"
+)
+
+// KubernetesSnapshotStore stores each snapshot as JSON in a ConfigMap or Secret of its own, in a single namespace.
+// Secrets suit clusters where the protected fields may hold sensitive values, e.g. the data of Secrets.
+type KubernetesSnapshotStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	secrets   bool
+	retention Retention
+}
+
+// NewConfigMapSnapshotStore returns a store keeping the snapshots in ConfigMaps in the given namespace.
+func NewConfigMapSnapshotStore(clientset kubernetes.Interface, namespace string, retention Retention) *KubernetesSnapshotStore {
+	return &KubernetesSnapshotStore{clientset: clientset, namespace: namespace, retention: retention}
+}
+
+// NewSecretSnapshotStore returns a store keeping the snapshots in Secrets in the given namespace.
+func NewSecretSnapshotStore(clientset kubernetes.Interface, namespace string, retention Retention) *KubernetesSnapshotStore {
+	return &KubernetesSnapshotStore{clientset: clientset, namespace: namespace, secrets: true, retention: retention}
+}
+
+// snapshotObjectName returns the name of the object holding the snapshot of the given resource.
+func snapshotObjectName(ref ResourceRef) string {
+	sum := sha256.Sum256([]byte(ref.String()))
+	return "heimdall-snapshot-" + hex.EncodeToString(sum[:16])
+}
+
+func (s *KubernetesSnapshotStore) Get(ctx context.Context, ref ResourceRef) (*Snapshot, error) {
+	name := snapshotObjectName(ref)
+	data, err := s.get(ctx, name)
+	if k8serrors.IsNotFound(err) {
+		return nil, ErrNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot in %s/%s: %v", s.namespace, name, err)
+	}
+	if s.retention.expired(snapshot.Timestamp, time.Now()) {
+		return nil, ErrNoSnapshot
+	}
+	return snapshot, nil
+}
+
+func (s *KubernetesSnapshotStore) Put(ctx context.Context, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	meta := metav1.ObjectMeta{
+		Name:      snapshotObjectName(snapshot.ResourceRef),
+		Namespace: s.namespace,
+		Labels:    map[string]string{snapshotLabel: "true"},
+		Annotations: map[string]string{
+			snapshotResourceAnnotation:  snapshot.ResourceRef.String(),
+			snapshotTimestampAnnotation: snapshot.Timestamp.UTC().Format(time.RFC3339Nano),
+			snapshotHashAnnotation:      snapshot.Hash,
+		},
+	}
+
+	err = s.update(ctx, meta, data)
+	if k8serrors.IsNotFound(err) {
+		err = s.create(ctx, meta, data)
+		if k8serrors.IsAlreadyExists(err) {
+			// Created concurrently.
+			err = s.update(ctx, meta, data)
+		}
+	}
+	return err
+}
+
+func (s *KubernetesSnapshotStore) Delete(ctx context.Context, ref ResourceRef) error {
+	return s.remove(ctx, snapshotObjectName(ref))
+}
+
+func (s *KubernetesSnapshotStore) Prune(ctx context.Context) (int, error) {
+	if s.retention == (Retention{}) {
+		return 0, nil
+	}
+	objects, err := s.list(ctx)
+	if err != nil {
+		return 0, err
+	}
+	timestamps := make(map[string]time.Time, len(objects))
+	for _, meta := range objects {
+		timestamp, err := time.Parse(time.RFC3339Nano, meta.Annotations[snapshotTimestampAnnotation])
+		if err != nil {
+			timestamp = meta.CreationTimestamp.Time
+		}
+		timestamps[meta.Name] = timestamp
+	}
+
+	pruned := 0
+	for _, name := range s.retention.prune(timestamps, time.Now()) {
+		if err := s.remove(ctx, name); err != nil {
+			return pruned, fmt.Errorf("failed to delete snapshot %s/%s: %v", s.namespace, name, err)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// get returns the snapshot data of the object with the given name.
+func (s *KubernetesSnapshotStore) get(ctx context.Context, name string) ([]byte, error) {
+	if s.secrets {
+		secret, err := s.clientset.CoreV1().Secrets(s.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return secret.Data[snapshotKey], nil
+	}
+	cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(cm.Data[snapshotKey]), nil
+}
+
+func (s *KubernetesSnapshotStore) create(ctx context.Context, meta metav1.ObjectMeta, data []byte) error {
+	var err error
+	if s.secrets {
+		secret := &corev1.Secret{ObjectMeta: meta, Data: map[string][]byte{snapshotKey: data}}
+		_, err = s.clientset.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		cm := &corev1.ConfigMap{ObjectMeta: meta, Data: map[string]string{snapshotKey: string(data)}}
+		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+func (s *KubernetesSnapshotStore) update(ctx context.Context, meta metav1.ObjectMeta, data []byte) error {
+	var err error
+	if s.secrets {
+		secret := &corev1.Secret{ObjectMeta: meta, Data: map[string][]byte{snapshotKey: data}}
+		_, err = s.clientset.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	} else {
+		cm := &corev1.ConfigMap{ObjectMeta: meta, Data: map[string]string{snapshotKey: string(data)}}
+		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// remove deletes the object with the given name, if it exists.
+func (s *KubernetesSnapshotStore) remove(ctx context.Context, name string) error {
+	var err error
+	if s.secrets {
+		err = s.clientset.CoreV1().Secrets(s.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	} else {
+		err = s.clientset.CoreV1().ConfigMaps(s.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	}
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// list returns the metadata of all snapshot objects.
+func (s *KubernetesSnapshotStore) list(ctx context.Context) ([]metav1.ObjectMeta, error) {
+	opts := metav1.ListOptions{LabelSelector: snapshotLabel + "=true"}
+	var objects []metav1.ObjectMeta
+	if s.secrets {
+		list, err := s.clientset.CoreV1().Secrets(s.namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, secret := range list.Items {
+			objects = append(objects, secret.ObjectMeta)
+		}
+		return objects, nil
+	}
+	list, err := s.clientset.CoreV1().ConfigMaps(s.namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, cm := range list.Items {
+		objects = append(objects, cm.ObjectMeta)
+	}
+	return objects, nil
+}
@@ -0,0 +1,70 @@
+package reconcile
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemorySnapshotStore keeps the snapshots in memory. It does not survive restarts and is not shared between replicas,
+// so it suits development and tests.
+type MemorySnapshotStore struct {
+	mu        sync.Mutex
+	snapshots map[ResourceRef]*Snapshot
+	retention Retention
+}
+
+// NewMemorySnapshotStore returns an empty in-memory store. Its maximum number of entries is enforced on every Put.
+func NewMemorySnapshotStore(retention Retention) *MemorySnapshotStore {
+	return &MemorySnapshotStore{snapshots: make(map[ResourceRef]*Snapshot), retention: retention}
+}
+
+func (s *MemorySnapshotStore) Get(_ context.Context, ref ResourceRef) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot, ok := s.snapshots[ref]
+	if !ok || s.retention.expired(snapshot.Timestamp, time.Now()) {
+		return nil, ErrNoSnapshot
+	}
+	copied := *snapshot
+	return &copied, nil
+}
+
+func (s *MemorySnapshotStore) Put(_ context.Context, snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *snapshot
+	s.snapshots[snapshot.ResourceRef] = &copied
+	if s.retention.MaxEntries > 0 && len(s.snapshots) > s.retention.MaxEntries {
+		s.prune()
+	}
+	return nil
+}
+
+func (s *MemorySnapshotStore) Delete(_ context.Context, ref ResourceRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots, ref)
+	return nil
+}
+
+func (s *MemorySnapshotStore) Prune(context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prune(), nil
+}
+
+// prune deletes the snapshots beyond the retention limits, s.mu must be held.
+func (s *MemorySnapshotStore) prune() int {
+	timestamps := make(map[string]time.Time, len(s.snapshots))
+	refs := make(map[string]ResourceRef, len(s.snapshots))
+	for ref, snapshot := range s.snapshots {
+		timestamps[ref.String()] = snapshot.Timestamp
+		refs[ref.String()] = ref
+	}
+	pruned := s.retention.prune(timestamps, time.Now())
+	for _, key := range pruned {
+		delete(s.snapshots, refs[key])
+	}
+	return len(pruned)
+}
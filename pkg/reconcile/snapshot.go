@@ -0,0 +1,307 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stackrox/admission-controller-heimdall/internal/jsonpointer"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+	"time"
+)
+
+// ErrNoSnapshot is returned by SnapshotStore.Get if there is no snapshot of the resource.
+var ErrNoSnapshot = errors.New("no snapshot of the resource")
+
+// ResourceRef identifies a resource across API versions.
+type ResourceRef struct {
+	Group     string
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// RefOf returns the reference to the resource of the given event.
+func RefOf(event *Event) ResourceRef {
+	return ResourceRef{Group: event.Group, Kind: event.Kind, Namespace: event.Namespace, Name: event.Name}
+}
+
+func (r ResourceRef) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s", r.Group, r.Kind, r.Namespace, r.Name)
+}
+
+// Snapshot is the last state of the protected fields of a resource that its owner approved.
+type Snapshot struct {
+	ResourceRef
+	// Version is the API version the fields were recorded in.
+	Version string
+	// UID and ResourceVersion identify the state of the resource the snapshot was taken of.
+	UID             types.UID `json:",omitempty"`
+	ResourceVersion string    `json:",omitempty"`
+	// Owner is the owner who approved the state.
+	Owner string `json:",omitempty"`
+	// Timestamp is when the state was approved.
+	Timestamp time.Time
+	// Fields maps the JSON pointers (RFC 6901) of the protected values to the values. A nil value is a JSON null.
+	Fields map[string]interface{}
+	// Absent are the JSON pointers of the protected values that were absent.
+	Absent []string `json:",omitempty"`
+	// Excluded are the JSON pointers of values within the fields that are not protected, e.g. the ignored paths of a
+	// policy. They are left out of the fields, and keep their live values when the fields are restored.
+	Excluded []string `json:",omitempty"`
+	// Hash is the SHA-256 hash of the version, fields, absent and excluded paths, which identifies the recorded state
+	// regardless of when it was recorded.
+	Hash string `json:",omitempty"`
+}
+
+// NewSnapshot records the values at the protected paths of the given decoded object, leaving out the values at the
+// excluded paths. Protected paths nested in other protected paths are covered by those, and protected paths that are
+// excluded themselves are not recorded. The values are normalized by a round trip through JSON, so that snapshots of
+// the same state have the same hash.
+func NewSnapshot(ref ResourceRef, version string, obj map[string]interface{}, protected, excluded []string) (*Snapshot, error) {
+	s := &Snapshot{ResourceRef: ref, Version: version, Fields: make(map[string]interface{})}
+	for _, path := range protected {
+		if isNestedInAny(path, protected) || jsonpointer.IsUnderAny(path, excluded) {
+			continue
+		}
+		tokens, err := jsonpointer.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		// The excluded paths within the value, relative to it.
+		var within [][]string
+		for _, e := range excluded {
+			if jsonpointer.IsUnder(e, path) && e != path {
+				excludedTokens, err := jsonpointer.Parse(e)
+				if err != nil {
+					return nil, err
+				}
+				within = append(within, excludedTokens[len(tokens):])
+				s.Excluded = append(s.Excluded, e)
+			}
+		}
+		value, exists := jsonpointer.Lookup(obj, tokens)
+		if !exists {
+			s.Absent = append(s.Absent, path)
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value at %s: %v", path, err)
+		}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		for _, relative := range within {
+			value = jsonpointer.Remove(value, relative)
+		}
+		s.Fields[path] = value
+	}
+	s.Absent = sortUnique(s.Absent)
+	s.Excluded = sortUnique(s.Excluded)
+
+	hash, err := s.contentHash()
+	if err != nil {
+		return nil, err
+	}
+	s.Hash = hash
+	return s, nil
+}
+
+// contentHash returns the hash of the recorded state. Maps are encoded with sorted keys, so the encoding is canonical.
+func (s *Snapshot) contentHash() (string, error) {
+	data, err := json.Marshal(struct {
+		Version  string
+		Fields   map[string]interface{}
+		Absent   []string `json:",omitempty"`
+		Excluded []string
+	}{s.Version, s.Fields, s.Absent, s.Excluded})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SnapshotStore stores the last snapshot of each resource.
+type SnapshotStore interface {
+	// Get returns the snapshot of the given resource, or ErrNoSnapshot.
+	Get(ctx context.Context, ref ResourceRef) (*Snapshot, error)
+	// Put stores the given snapshot, replacing the previous snapshot of the resource.
+	Put(ctx context.Context, snapshot *Snapshot) error
+	// Delete deletes the snapshot of the given resource, if any.
+	Delete(ctx context.Context, ref ResourceRef) error
+	// Prune deletes the snapshots beyond the retention limits of the store, and returns how many it deleted.
+	Prune(ctx context.Context) (int, error)
+}
+
+// Retention limits the snapshots kept by a store. Zero values mean no limit.
+type Retention struct {
+	// MaxEntries is the number of snapshots kept, beyond which the oldest are pruned.
+	MaxEntries int
+	// MaxAge is the age beyond which snapshots are pruned, and no longer returned.
+	MaxAge time.Duration
+}
+
+// expired checks if a snapshot taken at the given time is beyond the maximum age.
+func (r Retention) expired(timestamp, now time.Time) bool {
+	return r.MaxAge > 0 && now.Sub(timestamp) > r.MaxAge
+}
+
+// prune returns the keys of the snapshots beyond the limits, given the timestamps of all snapshots by key.
+func (r Retention) prune(timestamps map[string]time.Time, now time.Time) []string {
+	var pruned, kept []string
+	for key, timestamp := range timestamps {
+		if r.expired(timestamp, now) {
+			pruned = append(pruned, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	if r.MaxEntries > 0 && len(kept) > r.MaxEntries {
+		sort.Slice(kept, func(i, j int) bool {
+			return timestamps[kept[i]].Before(timestamps[kept[j]])
+		})
+		pruned = append(pruned, kept[:len(kept)-r.MaxEntries]...)
+	}
+	return pruned
+}
+
+// PatchOperation is a JSON patch (RFC 6902) operation.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON encodes the operation. The value is only left out of remove operations, the other operations require it
+// even if it is null.
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type operation PatchOperation
+	return json.Marshal(operation(op))
+}
+
+// RestorePatch returns the JSON patch that restores the fields of the snapshot in the given decoded object, nil if
+// they already have the recorded values. The patch starts with a test of the object's resourceVersion, so that it
+// fails if the object changed in the meantime.
+func (s *Snapshot) RestorePatch(obj map[string]interface{}) []PatchOperation {
+	paths := make([]string, 0, len(s.Fields)+len(s.Absent))
+	for path := range s.Fields {
+		paths = append(paths, path)
+	}
+	paths = sortUnique(append(paths, s.Absent...))
+
+	var ops []PatchOperation
+	for _, path := range paths {
+		tokens, err := jsonpointer.Parse(path)
+		if err != nil {
+			continue
+		}
+		want, wantExists := s.desired(obj, path, tokens)
+		got, exists := jsonpointer.Lookup(obj, tokens)
+		switch {
+		case !wantExists && exists:
+			ops = append(ops, PatchOperation{Op: "remove", Path: path})
+		case !wantExists:
+		case !exists:
+			ops = append(ops, addOperations(obj, tokens, want)...)
+		case !jsonEqual(got, want):
+			ops = append(ops, PatchOperation{Op: "replace", Path: path, Value: want})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	resourceVersion, _ := jsonpointer.Lookup(obj, []string{"metadata", "resourceVersion"})
+	test := PatchOperation{Op: "test", Path: "/metadata/resourceVersion", Value: resourceVersion}
+	return append([]PatchOperation{test}, ops...)
+}
+
+// desired returns the value to restore at the given path of the fields, with its reference tokens: the recorded value,
+// with the live values of the excluded paths within it. The second return value is false if the value is to be absent.
+func (s *Snapshot) desired(obj map[string]interface{}, path string, tokens []string) (interface{}, bool) {
+	want, wantExists := s.Fields[path]
+	copied := false
+	for _, e := range s.Excluded {
+		if !jsonpointer.IsUnder(e, path) || e == path {
+			continue
+		}
+		excludedTokens, err := jsonpointer.Parse(e)
+		if err != nil {
+			continue
+		}
+		live, exists := jsonpointer.Lookup(obj, excludedTokens)
+		if !exists {
+			continue
+		}
+		if !copied {
+			// Copy the recorded value before grafting, and start from an empty object if it was absent.
+			if !wantExists {
+				want, wantExists = map[string]interface{}{}, true
+			} else {
+				data, _ := json.Marshal(want)
+				_ = json.Unmarshal(data, &want)
+			}
+			copied = true
+		}
+		want = jsonpointer.Set(want, excludedTokens[len(tokens):], live)
+	}
+	return want, wantExists
+}
+
+// addOperations returns the operation adding the given value at the given reference tokens to obj, creating the
+// missing objects on the way.
+func addOperations(obj map[string]interface{}, tokens []string, value interface{}) []PatchOperation {
+	// Find the deepest ancestor that exists, and add the value nested in objects below it.
+	i := len(tokens) - 1
+	for i > 0 {
+		if _, exists := jsonpointer.Lookup(obj, tokens[:i]); exists {
+			break
+		}
+		i--
+	}
+	for j := len(tokens) - 1; j > i; j-- {
+		value = map[string]interface{}{tokens[j]: value}
+	}
+	return []PatchOperation{{Op: "add", Path: jsonpointer.Join(tokens[:i+1]), Value: value}}
+}
+
+// isNestedInAny checks if the given JSON pointer points into the value of any of the other pointers.
+func isNestedInAny(pointer string, pointers []string) bool {
+	for _, other := range pointers {
+		if other != pointer && jsonpointer.IsUnder(pointer, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortUnique sorts the given JSON pointers and removes duplicates.
+func sortUnique(pointers []string) []string {
+	sort.Strings(pointers)
+	for i := len(pointers) - 1; i > 0; i-- {
+		if pointers[i] == pointers[i-1] {
+			pointers = append(pointers[:i], pointers[i+1:]...)
+		}
+	}
+	return pointers
+}
+
+// jsonEqual compares two decoded JSON values by their encoding, so that e.g. int64 and float64 numbers of the same
+// value are equal.
+func jsonEqual(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
@@ -0,0 +1,194 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNewSnapshot(t *testing.T) {
+	tests := []struct {
+		name      string
+		obj       string
+		protected []string
+		excluded  []string
+		// wantFields is the encoding of the recorded fields.
+		wantFields   string
+		wantAbsent   []string
+		wantExcluded []string
+	}{
+		{
+			name:       "values",
+			obj:        `{"spec":{"a":1,"b":{"c":"x"}}}`,
+			protected:  []string{"/spec/a", "/spec/b"},
+			wantFields: `{"/spec/a":1,"/spec/b":{"c":"x"}}`,
+		},
+		{
+			name:       "absent and null values",
+			obj:        `{"spec":{"a":null}}`,
+			protected:  []string{"/spec/a", "/spec/b", "/spec/b"},
+			wantFields: `{"/spec/a":null}`,
+			wantAbsent: []string{"/spec/b"},
+		},
+		{
+			name:       "paths nested in other paths",
+			obj:        `{"spec":{"a":{"b":1}}}`,
+			protected:  []string{"/spec/a/b", "/spec/a", "/spec/c/d", "/spec/c"},
+			wantFields: `{"/spec/a":{"b":1}}`,
+			wantAbsent: []string{"/spec/c"},
+		},
+		{
+			name:         "excluded paths",
+			obj:          `{"spec":{"a":{"b":1,"c":2},"d":3}}`,
+			protected:    []string{"/spec/a", "/spec/d", "/spec/e"},
+			excluded:     []string{"/spec/a/c", "/spec/d", "/spec/e/f", "/status"},
+			wantFields:   `{"/spec/a":{"b":1}}`,
+			wantAbsent:   []string{"/spec/e"},
+			wantExcluded: []string{"/spec/a/c", "/spec/e/f"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSnapshot(ResourceRef{Kind: "Deployment"}, "v1", decodeTestJSON(t, tt.obj), tt.protected, tt.excluded)
+			if err != nil {
+				t.Fatalf("NewSnapshot failed: %v", err)
+			}
+			if want := decodeTestJSON(t, tt.wantFields); !reflect.DeepEqual(s.Fields, want) {
+				t.Errorf("Fields = %v, want %v", s.Fields, want)
+			}
+			if !reflect.DeepEqual(s.Absent, tt.wantAbsent) {
+				t.Errorf("Absent = %v, want %v", s.Absent, tt.wantAbsent)
+			}
+			if !reflect.DeepEqual(s.Excluded, tt.wantExcluded) {
+				t.Errorf("Excluded = %v, want %v", s.Excluded, tt.wantExcluded)
+			}
+		})
+	}
+}
+
+func TestSnapshotHash(t *testing.T) {
+	hash := func(obj string) string {
+		s, err := NewSnapshot(ResourceRef{Kind: "Deployment"}, "v1", decodeTestJSON(t, obj), []string{"/spec/a"}, nil)
+		if err != nil {
+			t.Fatalf("NewSnapshot failed: %v", err)
+		}
+		return s.Hash
+	}
+	if hash(`{"spec":{"a":{"x":1,"y":2}}}`) != hash(`{"spec":{"a":{"y":2,"x":1}},"status":{}}`) {
+		t.Error("snapshots of the same state have different hashes")
+	}
+	if hash(`{"spec":{"a":null}}`) == hash(`{"spec":{}}`) {
+		t.Error("snapshots of a null and an absent value have the same hash")
+	}
+}
+
+func TestRestorePatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		recorded  string
+		live      string
+		protected []string
+		excluded  []string
+		// wantPatch is the encoding of the patch.
+		wantPatch string
+	}{
+		{
+			name:      "unchanged values",
+			recorded:  `{"spec":{"a":1,"b":{"c":2}}}`,
+			live:      `{"metadata":{"resourceVersion":"7"},"spec":{"a":1,"b":{"c":2},"d":3}}`,
+			protected: []string{"/spec/a", "/spec/b", "/spec/e"},
+			wantPatch: `null`,
+		},
+		{
+			name:      "changed value",
+			recorded:  `{"spec":{"a":1}}`,
+			live:      `{"metadata":{"resourceVersion":"7"},"spec":{"a":2}}`,
+			protected: []string{"/spec/a"},
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":"7"},` +
+				`{"op":"replace","path":"/spec/a","value":1}]`,
+		},
+		{
+			name:      "added value",
+			recorded:  `{"spec":{}}`,
+			live:      `{"metadata":{"resourceVersion":"7"},"spec":{"a":1}}`,
+			protected: []string{"/spec/a"},
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":"7"},` +
+				`{"op":"remove","path":"/spec/a"}]`,
+		},
+		{
+			name:      "null value",
+			recorded:  `{"spec":{"a":null,"b":null}}`,
+			live:      `{"metadata":{"resourceVersion":"7"},"spec":{"a":1}}`,
+			protected: []string{"/spec/a", "/spec/b"},
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":"7"},` +
+				`{"op":"replace","path":"/spec/a","value":null},{"op":"add","path":"/spec/b","value":null}]`,
+		},
+		{
+			name:      "missing parents",
+			recorded:  `{"spec":{"template":{"metadata":{"labels":{"app":"web"}}}}}`,
+			live:      `{"metadata":{"resourceVersion":"7"},"spec":{}}`,
+			protected: []string{"/spec/template/metadata/labels/app"},
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":"7"},` +
+				`{"op":"add","path":"/spec/template","value":{"metadata":{"labels":{"app":"web"}}}}]`,
+		},
+		{
+			name:      "excluded paths keep their live values",
+			recorded:  `{"spec":{"a":{"x":1,"y":1}}}`,
+			live:      `{"metadata":{"resourceVersion":"7"},"spec":{"a":{"x":2,"y":2}}}`,
+			protected: []string{"/spec/a"},
+			excluded:  []string{"/spec/a/y"},
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":"7"},` +
+				`{"op":"replace","path":"/spec/a","value":{"x":1,"y":2}}]`,
+		},
+		{
+			name:      "excluded paths within an absent value",
+			recorded:  `{"spec":{}}`,
+			live:      `{"metadata":{"resourceVersion":"7"},"spec":{"a":{"x":2,"y":2}}}`,
+			protected: []string{"/spec/a"},
+			excluded:  []string{"/spec/a/y"},
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":"7"},` +
+				`{"op":"replace","path":"/spec/a","value":{"y":2}}]`,
+		},
+		{
+			name:      "missing resourceVersion",
+			recorded:  `{"spec":{"a":1}}`,
+			live:      `{"spec":{"a":2}}`,
+			protected: []string{"/spec/a"},
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":null},` +
+				`{"op":"replace","path":"/spec/a","value":1}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSnapshot(ResourceRef{Kind: "Deployment"}, "v1", decodeTestJSON(t, tt.recorded), tt.protected, tt.excluded)
+			if err != nil {
+				t.Fatalf("NewSnapshot failed: %v", err)
+			}
+			// Restore from a decoded copy, as the reconciler does with stored snapshots.
+			data, err := json.Marshal(s)
+			if err != nil {
+				t.Fatalf("failed to encode the snapshot: %v", err)
+			}
+			restored := &Snapshot{}
+			if err := json.Unmarshal(data, restored); err != nil {
+				t.Fatalf("failed to decode the snapshot: %v", err)
+			}
+			patch, err := json.Marshal(restored.RestorePatch(decodeTestJSON(t, tt.live)))
+			if err != nil {
+				t.Fatalf("failed to encode the patch: %v", err)
+			}
+			if string(patch) != tt.wantPatch {
+				t.Errorf("RestorePatch = %s, want %s", patch, tt.wantPatch)
+			}
+		})
+	}
+}
+
+func decodeTestJSON(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &doc); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", s, err)
+	}
+	return doc
+}
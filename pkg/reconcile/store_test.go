@@ -0,0 +1,247 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotStoreRetention(t *testing.T) {
+	stores := []struct {
+		name string
+		// newStore returns an empty store with the given retention, and a function counting its stored snapshots.
+		newStore func(t *testing.T, retention Retention) (SnapshotStore, func() int)
+	}{
+		{
+			name: "memory",
+			newStore: func(t *testing.T, retention Retention) (SnapshotStore, func() int) {
+				s := NewMemorySnapshotStore(retention)
+				return s, func() int {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					return len(s.snapshots)
+				}
+			},
+		},
+		{
+			name: "file",
+			newStore: func(t *testing.T, retention Retention) (SnapshotStore, func() int) {
+				dir := t.TempDir()
+				s, err := NewFileSnapshotStore(dir, retention)
+				if err != nil {
+					t.Fatalf("NewFileSnapshotStore failed: %v", err)
+				}
+				return s, func() int {
+					files, err := filepath.Glob(filepath.Join(dir, "*"+snapshotFileSuffix))
+					if err != nil {
+						t.Fatalf("failed to list the snapshot files: %v", err)
+					}
+					return len(files)
+				}
+			},
+		},
+		{
+			name: "configmap",
+			newStore: func(t *testing.T, retention Retention) (SnapshotStore, func() int) {
+				api := newTestAPIServer(t)
+				return NewConfigMapSnapshotStore(api.clientset, "heimdall", retention), func() int { return api.count("configmaps") }
+			},
+		},
+		{
+			name: "secret",
+			newStore: func(t *testing.T, retention Retention) (SnapshotStore, func() int) {
+				api := newTestAPIServer(t)
+				return NewSecretSnapshotStore(api.clientset, "heimdall", retention), func() int { return api.count("secrets") }
+			},
+		},
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name      string
+		retention Retention
+		// ages are the ages of the stored snapshots, which are stored in order.
+		ages []time.Duration
+		// wantKept are the indexes of the snapshots that are kept.
+		wantKept []int
+	}{
+		{
+			name:     "no limits",
+			ages:     []time.Duration{48 * time.Hour, time.Hour, time.Minute},
+			wantKept: []int{0, 1, 2},
+		},
+		{
+			name:      "maximum age",
+			retention: Retention{MaxAge: 2 * time.Hour},
+			ages:      []time.Duration{48 * time.Hour, time.Hour, 3 * time.Hour, time.Minute},
+			wantKept:  []int{1, 3},
+		},
+		{
+			name:      "maximum entries",
+			retention: Retention{MaxEntries: 2},
+			ages:      []time.Duration{time.Minute, 3 * time.Hour, time.Hour, 2 * time.Hour},
+			wantKept:  []int{0, 2},
+		},
+		{
+			name:      "maximum age and entries",
+			retention: Retention{MaxEntries: 2, MaxAge: 2 * time.Hour},
+			ages:      []time.Duration{48 * time.Hour, 3 * time.Minute, 2 * time.Minute, time.Minute},
+			wantKept:  []int{2, 3},
+		},
+	}
+	for _, store := range stores {
+		for _, tt := range tests {
+			t.Run(store.name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				s, count := store.newStore(t, tt.retention)
+				refs := make([]ResourceRef, len(tt.ages))
+				for i, age := range tt.ages {
+					refs[i] = ResourceRef{Kind: "Deployment", Namespace: "default", Name: fmt.Sprintf("app-%d", i)}
+					snapshot := &Snapshot{ResourceRef: refs[i], Version: "v1", Timestamp: now.Add(-age), Fields: map[string]interface{}{}}
+					if err := s.Put(ctx, snapshot); err != nil {
+						t.Fatalf("Put failed: %v", err)
+					}
+				}
+				if _, err := s.Prune(ctx); err != nil {
+					t.Fatalf("Prune failed: %v", err)
+				}
+
+				if got := count(); got != len(tt.wantKept) {
+					t.Errorf("%d snapshots stored after pruning, want %d", got, len(tt.wantKept))
+				}
+				kept := make(map[int]bool, len(tt.wantKept))
+				for _, i := range tt.wantKept {
+					kept[i] = true
+				}
+				for i, ref := range refs {
+					_, err := s.Get(ctx, ref)
+					switch {
+					case kept[i] && err != nil:
+						t.Errorf("Get(%s) failed: %v", ref, err)
+					case !kept[i] && !errors.Is(err, ErrNoSnapshot):
+						t.Errorf("Get(%s) = %v, want ErrNoSnapshot", ref, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// testAPIServer is a minimal Kubernetes API server storing the ConfigMaps and Secrets of the snapshot stores.
+type testAPIServer struct {
+	clientset kubernetes.Interface
+
+	mu sync.Mutex
+	// objects maps the resources, e.g. configmaps, to the encoded objects by name.
+	objects map[string]map[string]json.RawMessage
+}
+
+func newTestAPIServer(t *testing.T) *testAPIServer {
+	api := &testAPIServer{objects: make(map[string]map[string]json.RawMessage)}
+	server := httptest.NewServer(http.HandlerFunc(api.serveHTTP))
+	t.Cleanup(server.Close)
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatalf("failed to create the clientset: %v", err)
+	}
+	api.clientset = clientset
+	return api
+}
+
+// count returns the number of stored objects of the given resource.
+func (api *testAPIServer) count(resource string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return len(api.objects[resource])
+}
+
+// serveHTTP handles the requests to /api/v1/namespaces/<namespace>/<resource>[/<name>]. Label selectors are ignored.
+func (api *testAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) < 2 {
+		writeTestStatus(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	resource := parts[1]
+	objects := api.objects[resource]
+	if objects == nil {
+		objects = make(map[string]json.RawMessage)
+		api.objects[resource] = objects
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			items := make([]json.RawMessage, 0, len(objects))
+			for _, obj := range objects {
+				items = append(items, obj)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"apiVersion": "v1", "items": items})
+		case http.MethodPost:
+			body, _ := io.ReadAll(r.Body)
+			var obj struct {
+				Metadata struct{ Name string }
+			}
+			if err := json.Unmarshal(body, &obj); err != nil {
+				writeTestStatus(w, http.StatusBadRequest, "BadRequest")
+				return
+			}
+			if _, exists := objects[obj.Metadata.Name]; exists {
+				writeTestStatus(w, http.StatusConflict, "AlreadyExists")
+				return
+			}
+			objects[obj.Metadata.Name] = body
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(body)
+		default:
+			writeTestStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		}
+		return
+	}
+
+	name := parts[2]
+	obj, exists := objects[name]
+	if !exists {
+		writeTestStatus(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		_, _ = w.Write(obj)
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		objects[name] = body
+		_, _ = w.Write(body)
+	case http.MethodDelete:
+		delete(objects, name)
+		writeTestStatus(w, http.StatusOK, "")
+	default:
+		writeTestStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func writeTestStatus(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	status := "Success"
+	if code >= 300 {
+		status = "Failure"
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind": "Status", "apiVersion": "v1", "status": status, "reason": reason, "code": code,
+	})
+}